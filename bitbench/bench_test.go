@@ -24,6 +24,12 @@ func loadHashes(b *testing.B) error {
 	defer f.Close()
 	reader := bufio.NewReader(f)
 	sz, _ := reader.ReadByte()
+	// Newer caches start with a version byte, and store the size and fingerprint after the mtime
+	extra := 0
+	if sz&128 != 0 {
+		sz, _ = reader.ReadByte()
+		extra = 16
+	}
 	if sz != imgsort.HASH_SIZE {
 		return errors.New("unexpected hash size")
 	}
@@ -43,6 +49,10 @@ func loadHashes(b *testing.B) error {
 		if err != nil {
 			break
 		}
+		_, err = reader.Discard(extra)
+		if err != nil {
+			break
+		}
 		_, err = io.ReadFull(reader, hashes[i][:])
 		if err != nil {
 			break
@@ -0,0 +1,511 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package cache reads and writes imgSort.cache, which stores the image hashes used by the deduplicator.
+//
+// The file starts with a version byte. It has the high bit set, so versions of ImageSort from before it
+// was added throw the cache out instead of misreading it. Version 1 follows with the hash size in bits per side
+// and the number of entries as a big endian uint32. Each entry is a null-terminated path,
+// the modification time as a big endian uint32, the file size and fingerprint as big endian uint64s,
+// and then the hash, which is HashSize*HashSize/8 bytes.
+//
+// Older caches have no version byte and start with the hash size. Their entries have no size or fingerprint.
+//
+// Paths are relative to the library root and always use forward slashes,
+// so a cache can be moved between OSes.
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const VERSION = 1
+
+type Entry struct {
+	Hash    []byte
+	ModTime int64
+	// Size and Fingerprint are 0 if they aren't known
+	Size        int64
+	Fingerprint uint64
+}
+
+// A Cache is safe to use from more than one goroutine, except for changing HashSize.
+type Cache struct {
+	HashSize byte
+	lock     sync.Mutex
+	entries  map[string]Entry
+	// Paths by size and fingerprint, built when it is first needed
+	prints map[print][]string
+}
+
+type print struct {
+	size int64
+	fp   uint64
+}
+
+func New(hashSize byte) *Cache {
+	return &Cache{HashSize: hashSize, entries: make(map[string]Entry, 128)}
+}
+
+// Load reads a cache from a file. If the file doesn't exist, or was made with a different
+// hash size than hashSize, an empty cache is returned. A hashSize of 0 accepts any size.
+func Load(name string, hashSize byte) (*Cache, error) {
+	f, err := os.Open(name)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return New(hashSize), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Read(f)
+	if err != nil {
+		return nil, err
+	}
+	if hashSize != 0 && c.HashSize != hashSize {
+		return New(hashSize), nil
+	}
+	return c, nil
+}
+
+// Read reads a cache in the imgSort.cache format.
+// An entry cut off at the end is ignored.
+func Read(r io.Reader) (*Cache, error) {
+	reader := bufio.NewReader(r)
+	sz, err := reader.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return New(0), nil
+		}
+		return nil, err
+	}
+	version := 0
+	if sz&128 != 0 {
+		version = int(sz & 127)
+		if version > VERSION {
+			return New(0), nil
+		}
+		sz, err = reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return New(0), nil
+			}
+			return nil, err
+		}
+	}
+	size := HashBytes(sz)
+	temp := make([]byte, 8)
+	_, err = io.ReadFull(reader, temp[:4])
+	if err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(temp)
+	// Don't trust the count too much, it could be garbage
+	c := &Cache{HashSize: sz, entries: make(map[string]Entry, min(count, 1<<16))}
+	var s string
+	for {
+		s, err = reader.ReadString(0)
+		if err != nil {
+			break
+		}
+		s = s[:len(s)-1]
+		_, err = io.ReadFull(reader, temp[:4])
+		if err != nil {
+			break
+		}
+		e := Entry{ModTime: int64(binary.BigEndian.Uint32(temp))}
+		if version > 0 {
+			_, err = io.ReadFull(reader, temp)
+			if err != nil {
+				break
+			}
+			e.Size = int64(binary.BigEndian.Uint64(temp))
+			_, err = io.ReadFull(reader, temp)
+			if err != nil {
+				break
+			}
+			e.Fingerprint = binary.BigEndian.Uint64(temp)
+		}
+		e.Hash = make([]byte, size)
+		_, err = io.ReadFull(reader, e.Hash)
+		if err != nil {
+			break
+		}
+		c.entries[s] = e
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return c, nil
+	}
+	return nil, err
+}
+
+// HashBytes is the length of a hash with the given size.
+func HashBytes(hashSize byte) int {
+	size := int(hashSize)
+	return size * size / 8
+}
+
+// Save writes the cache to a file, replacing it.
+func (c *Cache) Save(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = c.Write(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Write writes the cache in the current imgSort.cache format.
+// Entries without a hash, or with a hash of the wrong length, are left out.
+func (c *Cache) Write(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	size := HashBytes(c.HashSize)
+	keys := make([]string, 0, len(c.entries))
+	for k, v := range c.entries {
+		if len(v.Hash) == size && size != 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	writer := bufio.NewWriter(w)
+	writer.WriteByte(128 | VERSION)
+	writer.WriteByte(c.HashSize)
+	temp := make([]byte, 20)
+	binary.BigEndian.PutUint32(temp, uint32(len(keys)))
+	_, err := writer.Write(temp[:4])
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v := c.entries[k]
+		_, err = writer.WriteString(k)
+		if err != nil {
+			return err
+		}
+		writer.WriteByte(0)
+		binary.BigEndian.PutUint32(temp, uint32(v.ModTime))
+		binary.BigEndian.PutUint64(temp[4:], uint64(v.Size))
+		binary.BigEndian.PutUint64(temp[12:], v.Fingerprint)
+		_, err = writer.Write(temp)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(v.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func (c *Cache) Get(p string) (Entry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[p]
+	return e, ok
+}
+
+func (c *Cache) Put(p string, e Entry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.put(p, e)
+}
+
+func (c *Cache) put(p string, e Entry) {
+	c.remove(p)
+	c.entries[p] = e
+	if c.prints != nil && e.Size != 0 {
+		k := print{e.Size, e.Fingerprint}
+		c.prints[k] = append(c.prints[k], p)
+	}
+}
+
+func (c *Cache) Delete(p string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(p)
+}
+
+func (c *Cache) remove(p string) {
+	e, ok := c.entries[p]
+	if !ok {
+		return
+	}
+	delete(c.entries, p)
+	if c.prints != nil && e.Size != 0 {
+		k := print{e.Size, e.Fingerprint}
+		ls := c.prints[k]
+		for i, v := range ls {
+			if v == p {
+				ls[i] = ls[len(ls)-1]
+				ls = ls[:len(ls)-1]
+				break
+			}
+		}
+		if len(ls) == 0 {
+			delete(c.prints, k)
+		} else {
+			c.prints[k] = ls
+		}
+	}
+}
+
+// Move moves the entry for from to to, if there is one.
+func (c *Cache) Move(from, to string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[from]
+	if !ok {
+		return
+	}
+	c.remove(from)
+	c.put(to, e)
+}
+
+// Copy gives to the same entry as from, if there is one.
+func (c *Cache) Copy(from, to string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[from]
+	if !ok || from == to {
+		return
+	}
+	c.put(to, e)
+}
+
+// Swap swaps the entries of two paths.
+func (c *Cache) Swap(a, b string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ea, okA := c.entries[a]
+	eb, okB := c.entries[b]
+	c.remove(a)
+	c.remove(b)
+	if okA {
+		c.put(b, ea)
+	}
+	if okB {
+		c.put(a, eb)
+	}
+}
+
+// Clear removes every entry and changes the hash size.
+func (c *Cache) Clear(hashSize byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.HashSize = hashSize
+	c.entries = make(map[string]Entry, 128)
+	c.prints = nil
+}
+
+// DeleteIf removes every entry that f returns true for.
+func (c *Cache) DeleteIf(f func(string, Entry) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, v := range c.entries {
+		if f(k, v) {
+			c.remove(k)
+		}
+	}
+}
+
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Range calls f for every entry, in no particular order. f must not use the cache.
+func (c *Cache) Range(f func(string, Entry)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, v := range c.entries {
+		f(k, v)
+	}
+}
+
+// Keys returns every path in the cache, sorted.
+func (c *Cache) Keys() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.keys()
+}
+
+func (c *Cache) keys() []string {
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Problem is an entry that doesn't match the file it is for.
+type Problem struct {
+	Path   string
+	Reason string
+}
+
+const (
+	REASON_MISSING  = "missing"
+	REASON_MODIFIED = "modified"
+	REASON_BADHASH  = "wrong hash length"
+)
+
+func (c *Cache) check(root, k string, v Entry) string {
+	if len(v.Hash) != HashBytes(c.HashSize) {
+		return REASON_BADHASH
+	}
+	info, err := os.Stat(filepath.Join(root, filepath.FromSlash(k)))
+	if err != nil && os.IsNotExist(err) {
+		return REASON_MISSING
+	} else if err == nil && info.ModTime().Unix() != v.ModTime {
+		return REASON_MODIFIED
+	}
+	return ""
+}
+
+// Verify checks every entry against the files in root without changing anything.
+func (c *Cache) Verify(root string) []Problem {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.verify(root)
+}
+
+func (c *Cache) verify(root string) []Problem {
+	out := make([]Problem, 0)
+	for _, k := range c.keys() {
+		if reason := c.check(root, k, c.entries[k]); reason != "" {
+			out = append(out, Problem{k, reason})
+		}
+	}
+	return out
+}
+
+// Prune removes entries for files in root that are missing or were modified since they were hashed.
+// Paths with backslashes from older versions on Windows are fixed first.
+func (c *Cache) Prune(root string) []Problem {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if os.PathSeparator == '\\' {
+		for k, v := range c.entries {
+			if strings.ContainsRune(k, '\\') {
+				c.remove(k)
+				c.put(strings.ReplaceAll(k, "\\", "/"), v)
+			}
+		}
+	}
+	out := c.verify(root)
+	for _, v := range out {
+		c.remove(v.Path)
+	}
+	return out
+}
+
+// Rehash computes the hash of every entry again with hash, which is given the path of the file in root.
+// Entries that fail to hash are removed. progress is called after each entry if it isn't nil.
+func (c *Cache) Rehash(root string, hash func(string) ([]byte, int64, error), progress func(int, int)) []Problem {
+	out := make([]Problem, 0)
+	keys := c.Keys()
+	for i, k := range keys {
+		p := filepath.Join(root, filepath.FromSlash(k))
+		hsh, modTime, err := hash(p)
+		var size int64
+		var fp uint64
+		if err == nil {
+			size, fp, err = Fingerprint(p)
+		}
+		if err != nil {
+			c.Delete(k)
+			out = append(out, Problem{k, err.Error()})
+		} else {
+			c.Put(k, Entry{hsh, modTime, size, fp})
+		}
+		if progress != nil {
+			progress(i+1, len(keys))
+		}
+	}
+	return out
+}
+
+// Stats counts how many bytes of a cache file each folder takes up.
+// The header and null terminators are counted under "(padding)", unless nterm is set,
+// in which case null terminators are counted as part of their folder.
+func Stats(r io.Reader, nterm bool) (map[string]int, error) {
+	reader := bufio.NewReader(r)
+	hashSize, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	header := 5
+	size := 4
+	if hashSize&128 != 0 {
+		if hashSize&127 > VERSION {
+			return nil, errors.New("cache is from a newer version")
+		}
+		hashSize, err = reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		header++
+		size += 16
+	}
+	size += HashBytes(hashSize)
+	temp := make([]byte, 4)
+	_, err = io.ReadFull(reader, temp)
+	if err != nil {
+		return nil, err
+	}
+	entries := binary.BigEndian.Uint32(temp)
+	folders := make(map[string]int, entries/128)
+	folders["(padding)"] = header
+	var s string
+	for {
+		s, err = reader.ReadString(0)
+		if err != nil {
+			break
+		}
+		fldr := path.Dir(s[:len(s)-1])
+		if nterm {
+			folders[fldr] += len(s)
+		} else {
+			folders[fldr] += len(s) - 1
+			folders["(padding)"]++
+		}
+		_, err = reader.Discard(size)
+		if err != nil {
+			return nil, err
+		}
+		folders[fldr] += size
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return folders, nil
+}
@@ -0,0 +1,446 @@
+package cache_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlortiz0/ImageSort/cache"
+)
+
+func loadFixture(t *testing.T, name string) *cache.Cache {
+	t.Helper()
+	c, err := cache.Load(filepath.Join("testdata", name), 0)
+	if err != nil {
+		t.Fatalf("load %s: %s", name, err.Error())
+	}
+	return c
+}
+
+func TestRead(t *testing.T) {
+	c := loadFixture(t, "small.cache")
+	if c.HashSize != 8 {
+		t.Errorf("hash size %d, expected 8", c.HashSize)
+	}
+	keys := []string{"a/one.jpg", "a/two.png", "b/three.gif"}
+	if !reflect.DeepEqual(c.Keys(), keys) {
+		t.Fatalf("keys %v, expected %v", c.Keys(), keys)
+	}
+	e, _ := c.Get("a/one.jpg")
+	if e.ModTime != 1000 || !bytes.Equal(e.Hash, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("bad entry %v", e)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	c := loadFixture(t, "truncated.cache")
+	if c.Len() != 2 {
+		t.Errorf("%d entries, expected 2", c.Len())
+	}
+	if _, ok := c.Get("b/three.gif"); ok {
+		t.Error("truncated entry was kept")
+	}
+}
+
+func TestReadVersioned(t *testing.T) {
+	c := loadFixture(t, "versioned.cache")
+	if c.Len() != 0 {
+		t.Errorf("%d entries from a newer format, expected 0", c.Len())
+	}
+}
+
+func TestLoadHashSize(t *testing.T) {
+	c, err := cache.Load(filepath.Join("testdata", "small.cache"), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 0 || c.HashSize != 16 {
+		t.Errorf("cache with a different hash size was not reset")
+	}
+	c, err = cache.Load(filepath.Join("testdata", "missing.cache"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 0 {
+		t.Errorf("missing cache has %d entries", c.Len())
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	c := loadFixture(t, "small_v1.cache")
+	if c.HashSize != 8 || c.Len() != 3 {
+		t.Fatalf("hash size %d with %d entries, expected 8 and 3", c.HashSize, c.Len())
+	}
+	e, _ := c.Get("a/two.png")
+	if e.ModTime != 2000 || e.Size != 200 || e.Fingerprint != 0x2222 || !bytes.Equal(e.Hash, []byte{16, 17, 18, 19, 20, 21, 22, 23}) {
+		t.Errorf("bad entry %v", e)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "small_v1.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cache.Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = c.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("written cache differs from fixture")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	c := loadFixture(t, "small.cache")
+	buf := new(bytes.Buffer)
+	err := c.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Bytes()[0] != 128|cache.VERSION {
+		t.Errorf("written with version byte %x", buf.Bytes()[0])
+	}
+	c2, err := cache.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range c.Keys() {
+		e, _ := c.Get(k)
+		e2, _ := c2.Get(k)
+		if !reflect.DeepEqual(e, e2) {
+			t.Errorf("%s: %v became %v", k, e, e2)
+		}
+	}
+}
+
+func TestWriteSkipsBadHashes(t *testing.T) {
+	c := cache.New(8)
+	c.Put("good.jpg", cache.Entry{Hash: make([]byte, 8), ModTime: 1})
+	c.Put("bad.jpg", cache.Entry{Hash: make([]byte, 3), ModTime: 1})
+	c.Put("nil.jpg", cache.Entry{ModTime: 1})
+	buf := new(bytes.Buffer)
+	err := c.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := cache.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c2.Keys(), []string{"good.jpg"}) {
+		t.Errorf("keys %v, expected only good.jpg", c2.Keys())
+	}
+}
+
+func TestMoveSwap(t *testing.T) {
+	c := loadFixture(t, "small.cache")
+	one, _ := c.Get("a/one.jpg")
+	two, _ := c.Get("a/two.png")
+	c.Swap("a/one.jpg", "a/two.png")
+	if e, _ := c.Get("a/one.jpg"); !bytes.Equal(e.Hash, two.Hash) {
+		t.Error("swap did not swap")
+	}
+	c.Move("a/two.png", "c/one.jpg")
+	if e, ok := c.Get("c/one.jpg"); !ok || !bytes.Equal(e.Hash, one.Hash) {
+		t.Error("move lost the entry")
+	}
+	if _, ok := c.Get("a/two.png"); ok {
+		t.Error("move left the old entry")
+	}
+	c.Move("nothing", "c/one.jpg")
+	if _, ok := c.Get("c/one.jpg"); !ok {
+		t.Error("moving a missing entry removed the target")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c := loadFixture(t, "small.cache")
+	one, _ := c.Get("a/one.jpg")
+	c.Copy("a/one.jpg", "c/one.jpg")
+	if e, ok := c.Get("c/one.jpg"); !ok || !bytes.Equal(e.Hash, one.Hash) {
+		t.Error("copy did not add the entry")
+	}
+	if _, ok := c.Get("a/one.jpg"); !ok {
+		t.Error("copy removed the old entry")
+	}
+	if one.Size != 0 && len(c.Lookup(one.Size, one.Fingerprint)) != 2 {
+		t.Error("copy is missing from the fingerprint index")
+	}
+	c.Copy("nothing", "c/one.jpg")
+	if _, ok := c.Get("c/one.jpg"); !ok {
+		t.Error("copying a missing entry removed the target")
+	}
+}
+
+// makeLibrary creates the files in the fixture in a temporary folder.
+// a/one.jpg matches its entry, a/two.png was modified, and b/three.gif is missing.
+func makeLibrary(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "a"), 0700)
+	for name, mtime := range map[string]int64{"one.jpg": 1000, "two.png": 2500} {
+		p := filepath.Join(root, "a", name)
+		err := os.WriteFile(p, nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(p, time.Unix(mtime, 0), time.Unix(mtime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestVerify(t *testing.T) {
+	root := makeLibrary(t)
+	c := loadFixture(t, "small.cache")
+	problems := c.Verify(root)
+	expected := []cache.Problem{{Path: "a/two.png", Reason: cache.REASON_MODIFIED}, {Path: "b/three.gif", Reason: cache.REASON_MISSING}}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("problems %v, expected %v", problems, expected)
+	}
+	if c.Len() != 3 {
+		t.Error("verify changed the cache")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	root := makeLibrary(t)
+	c := loadFixture(t, "small.cache")
+	removed := c.Prune(root)
+	if len(removed) != 2 {
+		t.Errorf("removed %v, expected 2 entries", removed)
+	}
+	if !reflect.DeepEqual(c.Keys(), []string{"a/one.jpg"}) {
+		t.Errorf("keys %v, expected only a/one.jpg", c.Keys())
+	}
+}
+
+func TestRehash(t *testing.T) {
+	root := makeLibrary(t)
+	c := loadFixture(t, "small.cache")
+	c.HashSize = 4
+	failed := c.Rehash(root, func(p string) ([]byte, int64, error) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []byte{42, 42}, info.ModTime().Unix(), nil
+	}, nil)
+	if len(failed) != 1 || failed[0].Path != "b/three.gif" {
+		t.Errorf("failed %v, expected only b/three.gif", failed)
+	}
+	e, _ := c.Get("a/two.png")
+	if e.ModTime != 2500 || !bytes.Equal(e.Hash, []byte{42, 42}) {
+		t.Errorf("bad entry %v after rehash", e)
+	}
+}
+
+func TestStats(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "small.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	folders, err := cache.Stats(f, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name without the terminator, the mtime and the hash
+	expected := map[string]int{"(padding)": 8, "a": 9 + 9 + 24, "b": 11 + 12}
+	if !reflect.DeepEqual(folders, expected) {
+		t.Errorf("stats %v, expected %v", folders, expected)
+	}
+	total := 0
+	for _, v := range folders {
+		total += v
+	}
+	if total != 73 {
+		t.Errorf("stats add up to %d, expected the file size of 73", total)
+	}
+	f2, err := os.Open(filepath.Join("testdata", "small_v1.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	folders, err = cache.Stats(f2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name with the terminator, the mtime, size, fingerprint and the hash
+	expected = map[string]int{"(padding)": 6, "a": 10 + 10 + 2*28, "b": 12 + 28}
+	if !reflect.DeepEqual(folders, expected) {
+		t.Errorf("v1 stats %v, expected %v", folders, expected)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []string{cache.FORMAT_JSON, cache.FORMAT_CSV} {
+		c := loadFixture(t, "small_v1.cache")
+		buf := new(bytes.Buffer)
+		err := c.Export(buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2 := cache.New(8)
+		merged, skipped, err := c2.Import(buf, format)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err.Error())
+		}
+		if merged != 3 || skipped != 0 || !reflect.DeepEqual(c.Keys(), c2.Keys()) {
+			t.Errorf("%s: merged %d, skipped %d: %v", format, merged, skipped, c2.Keys())
+		}
+		for _, k := range c.Keys() {
+			e, _ := c.Get(k)
+			e2, _ := c2.Get(k)
+			if !reflect.DeepEqual(e, e2) {
+				t.Errorf("%s: %v became %v", format, e, e2)
+			}
+		}
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	c := loadFixture(t, "small.cache")
+	buf := new(bytes.Buffer)
+	c.Export(buf, cache.FORMAT_JSON)
+	if !strings.HasPrefix(buf.String(), `{"path":"a/one.jpg","mtime":1000,"hash":"0102030405060708","hash_size":8}`+"\n") {
+		t.Errorf("unexpected json %q", buf.String())
+	}
+	buf.Reset()
+	c.Export(buf, cache.FORMAT_CSV)
+	if !strings.HasPrefix(buf.String(), "path,mtime,hash,hash_size,size,fingerprint\na/one.jpg,1000,0102030405060708,8,0,\n") {
+		t.Errorf("unexpected csv %q", buf.String())
+	}
+	buf.Reset()
+	loadFixture(t, "small_v1.cache").Export(buf, cache.FORMAT_JSON)
+	if !strings.HasPrefix(buf.String(), `{"path":"a/one.jpg","mtime":1000,"hash":"0102030405060708","hash_size":8,"size":100,"fingerprint":"1111"}`+"\n") {
+		t.Errorf("unexpected json %q", buf.String())
+	}
+	if c.Export(buf, "xml") != cache.ErrBadFormat {
+		t.Error("unknown format was accepted")
+	}
+}
+
+func TestImportMerge(t *testing.T) {
+	c := loadFixture(t, "small.cache")
+	in := `path,mtime,hash,hash_size
+a/one.jpg,999,0000000000000000,8
+a/two.png,2001,0000000000000000,8
+c/four.jpg,1,0000000000000000,8
+c/five.jpg,1,00000000000000000000000000000000,16
+`
+	merged, skipped, err := c.Import(strings.NewReader(in), cache.FORMAT_CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != 2 || skipped != 2 {
+		t.Errorf("merged %d, skipped %d, expected 2 and 2", merged, skipped)
+	}
+	if e, _ := c.Get("a/one.jpg"); e.ModTime != 1000 {
+		t.Error("older entry replaced a newer one")
+	}
+	if e, _ := c.Get("a/two.png"); e.ModTime != 2001 {
+		t.Error("newer entry was not merged")
+	}
+	if _, ok := c.Get("c/five.jpg"); ok {
+		t.Error("entry with a different hash size was merged")
+	}
+	_, _, err = c.Import(strings.NewReader(`{"path":"x.jpg","mtime":1,"hash":"zz"}`), cache.FORMAT_JSON)
+	if err == nil {
+		t.Error("bad hash was accepted")
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "a"), 0700)
+	os.Mkdir(filepath.Join(root, "b"), 0700)
+	data := bytes.Repeat([]byte("ImageSort"), 30000)
+	err := os.WriteFile(filepath.Join(root, "a", "old.jpg"), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, fp, err := cache.Fingerprint(filepath.Join(root, "a", "old.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || fp == 0 {
+		t.Fatalf("fingerprint %d %x", size, fp)
+	}
+	c := cache.New(8)
+	c.Put("a/old.jpg", cache.Entry{Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8}, ModTime: 1, Size: size, Fingerprint: fp})
+	// A copy keeps both entries
+	os.WriteFile(filepath.Join(root, "b", "copy.jpg"), data, 0600)
+	// A move takes the entry
+	os.Rename(filepath.Join(root, "a", "old.jpg"), filepath.Join(root, "b", "new.jpg"))
+	os.WriteFile(filepath.Join(root, "b", "other.jpg"), data[1:], 0600)
+	reused := c.Rescan(root, []string{"b/new.jpg", "b/other.jpg"})
+	if reused != 1 {
+		t.Errorf("reused %d entries, expected 1", reused)
+	}
+	if !reflect.DeepEqual(c.Keys(), []string{"b/new.jpg"}) {
+		t.Errorf("keys %v after a move", c.Keys())
+	}
+	if _, ok := c.Relocate(root, "b/copy.jpg", size, fp, 2); !ok {
+		t.Error("copy was not found")
+	}
+	if !reflect.DeepEqual(c.Keys(), []string{"b/copy.jpg", "b/new.jpg"}) {
+		t.Errorf("keys %v after a copy", c.Keys())
+	}
+	if e, _ := c.Get("b/copy.jpg"); e.ModTime != 2 || e.Hash[0] != 1 {
+		t.Errorf("bad entry %v for copy", e)
+	}
+}
+
+func TestRescanUpgrades(t *testing.T) {
+	root := makeLibrary(t)
+	c := loadFixture(t, "small.cache")
+	c.Rescan(root, []string{"a/one.jpg"})
+	if e, _ := c.Get("a/one.jpg"); e.Size != 0 || e.Fingerprint != 0 {
+		// Empty files have nothing to fingerprint
+		t.Errorf("empty file got a fingerprint %v", e)
+	}
+	os.WriteFile(filepath.Join(root, "a", "one.jpg"), []byte("data"), 0600)
+	os.Chtimes(filepath.Join(root, "a", "one.jpg"), time.Unix(1000, 0), time.Unix(1000, 0))
+	c.Rescan(root, []string{"a/one.jpg"})
+	if e, _ := c.Get("a/one.jpg"); e.Size != 4 || e.Fingerprint == 0 || e.ModTime != 1000 {
+		t.Errorf("entry was not given a fingerprint %v", e)
+	}
+}
+
+// The file for each entry is missing, so Relocate moves it
+func TestConcurrent(t *testing.T) {
+	c := cache.New(8)
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 100; j++ {
+				p := fmt.Sprintf("%d/%d.jpg", i, j)
+				c.Put(p, cache.Entry{Hash: make([]byte, 8), ModTime: int64(j), Size: 1, Fingerprint: uint64(i*1000 + j)})
+				c.Get(p)
+				c.Relocate(".", p+"2", 1, uint64(i*1000+j), 0)
+				c.Delete(p)
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	if c.Len() != 400 {
+		t.Errorf("%d entries, expected 400", c.Len())
+	}
+}
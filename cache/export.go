@@ -0,0 +1,190 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Record is one entry in a form other tools can read.
+// It holds the same fields as an entry in imgSort.cache, plus the hash size that is normally in the header.
+type Record struct {
+	Path        string `json:"path"`
+	ModTime     int64  `json:"mtime"`
+	Hash        string `json:"hash"`
+	HashSize    byte   `json:"hash_size"`
+	Size        int64  `json:"size,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_CSV  = "csv"
+)
+
+// Files exported before size and fingerprint were added only have the first four columns
+var csvHeader = []string{"path", "mtime", "hash", "hash_size", "size", "fingerprint"}
+
+var ErrBadFormat = errors.New("unknown format, expected json or csv")
+
+// Export writes every entry as JSON lines or CSV, sorted by path.
+func (c *Cache) Export(w io.Writer, format string) error {
+	var put func(Record) error
+	var flush func() error
+	switch format {
+	case FORMAT_JSON:
+		writer := bufio.NewWriter(w)
+		enc := json.NewEncoder(writer)
+		put = func(rec Record) error { return enc.Encode(rec) }
+		flush = writer.Flush
+	case FORMAT_CSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		put = func(rec Record) error {
+			return cw.Write([]string{rec.Path, strconv.FormatInt(rec.ModTime, 10), rec.Hash, strconv.Itoa(int(rec.HashSize)), strconv.FormatInt(rec.Size, 10), rec.Fingerprint})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return ErrBadFormat
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, k := range c.keys() {
+		v := c.entries[k]
+		rec := Record{Path: k, ModTime: v.ModTime, Hash: hex.EncodeToString(v.Hash), HashSize: c.HashSize}
+		if v.Size != 0 {
+			rec.Size = v.Size
+			rec.Fingerprint = strconv.FormatUint(v.Fingerprint, 16)
+		}
+		err := put(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// Merge adds a record to the cache. If there is already an entry for the path, the one with the newest
+// modification time is kept. Records with a different hash size are skipped.
+// It returns true if the cache was changed.
+func (c *Cache) Merge(rec Record) (bool, error) {
+	if rec.HashSize != 0 && rec.HashSize != c.HashSize {
+		return false, nil
+	}
+	hsh, err := hex.DecodeString(rec.Hash)
+	if err != nil {
+		return false, err
+	}
+	if len(hsh) != HashBytes(c.HashSize) {
+		return false, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if old, ok := c.entries[rec.Path]; ok && old.ModTime >= rec.ModTime {
+		return false, nil
+	}
+	e := Entry{Hash: hsh, ModTime: rec.ModTime}
+	if rec.Fingerprint != "" {
+		e.Size = rec.Size
+		e.Fingerprint, err = strconv.ParseUint(rec.Fingerprint, 16, 64)
+		if err != nil {
+			return false, err
+		}
+	}
+	c.put(rec.Path, e)
+	return true, nil
+}
+
+// Import merges records written by Export into the cache.
+// It returns how many records were merged and how many were skipped.
+func (c *Cache) Import(r io.Reader, format string) (int, int, error) {
+	var next func() (Record, error)
+	switch format {
+	case FORMAT_JSON:
+		dec := json.NewDecoder(r)
+		next = func() (Record, error) {
+			var rec Record
+			err := dec.Decode(&rec)
+			return rec, err
+		}
+	case FORMAT_CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		first := true
+		next = func() (Record, error) {
+			row, err := cr.Read()
+			if first && err == nil && row[0] == csvHeader[0] {
+				row, err = cr.Read()
+			}
+			first = false
+			if err != nil {
+				return Record{}, err
+			}
+			if len(row) != 4 && len(row) != len(csvHeader) {
+				return Record{}, fmt.Errorf("expected %d columns, got %d", len(csvHeader), len(row))
+			}
+			modTime, err := strconv.ParseInt(row[1], 10, 64)
+			if err != nil {
+				return Record{}, err
+			}
+			hashSize, err := strconv.ParseUint(row[3], 10, 8)
+			if err != nil {
+				return Record{}, err
+			}
+			rec := Record{Path: row[0], ModTime: modTime, Hash: row[2], HashSize: byte(hashSize)}
+			if len(row) > 4 && row[5] != "" {
+				rec.Size, err = strconv.ParseInt(row[4], 10, 64)
+				rec.Fingerprint = row[5]
+			}
+			return rec, err
+		}
+	default:
+		return 0, 0, ErrBadFormat
+	}
+	merged, skipped := 0, 0
+	for line := 1; ; line++ {
+		rec, err := next()
+		if err == io.EOF {
+			return merged, skipped, nil
+		} else if err != nil {
+			return merged, skipped, fmt.Errorf("record %d: %w", line, err)
+		}
+		ok, err := c.Merge(rec)
+		if err != nil {
+			return merged, skipped, fmt.Errorf("record %d: %w", line, err)
+		}
+		if ok {
+			merged++
+		} else {
+			skipped++
+		}
+	}
+}
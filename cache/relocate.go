@@ -0,0 +1,147 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Only this much of the start and end of a file goes into its fingerprint
+const fingerprintChunk = 64 * 1024
+
+// Fingerprint returns the size of a file and a hash of its first and last 64KiB.
+// It is much cheaper than decoding the image, and is used to recognize a file that was moved or renamed.
+func Fingerprint(name string) (int64, uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+	h := fnv.New64a()
+	_, err = io.CopyN(h, f, fingerprintChunk)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if size > 2*fingerprintChunk {
+		_, err = f.Seek(-fingerprintChunk, io.SeekEnd)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	// If the file is small enough, this reads whatever is left after the first chunk
+	_, err = io.CopyN(h, f, fingerprintChunk)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	fp := h.Sum64()
+	if size == 0 {
+		// Keep 0 meaning unknown
+		fp = 0
+	}
+	return size, fp, nil
+}
+
+func (c *Cache) buildPrints() {
+	c.prints = make(map[print][]string, len(c.entries))
+	for k, v := range c.entries {
+		if v.Size != 0 {
+			key := print{v.Size, v.Fingerprint}
+			c.prints[key] = append(c.prints[key], k)
+		}
+	}
+}
+
+// Lookup returns the paths of every entry with the given size and fingerprint.
+func (c *Cache) Lookup(size int64, fp uint64) []string {
+	if size == 0 {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.prints == nil {
+		c.buildPrints()
+	}
+	return append([]string(nil), c.prints[print{size, fp}]...)
+}
+
+// Relocate looks for an entry with the same size and fingerprint as the file at p, which has been modified at modTime.
+// If one is found, it is used for p and returned. If the file it was for no longer exists in root, the old entry is removed.
+// Otherwise p is a copy, and both keep the entry.
+func (c *Cache) Relocate(root, p string, size int64, fp uint64, modTime int64) (Entry, bool) {
+	if size == 0 {
+		return Entry{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.prints == nil {
+		c.buildPrints()
+	}
+	key := print{size, fp}
+	for _, v := range c.prints[key] {
+		e := c.entries[v]
+		if len(e.Hash) != HashBytes(c.HashSize) {
+			continue
+		}
+		e.ModTime = modTime
+		if v != p {
+			_, err := os.Stat(filepath.Join(root, filepath.FromSlash(v)))
+			if err != nil && os.IsNotExist(err) {
+				c.remove(v)
+			}
+		}
+		c.put(p, e)
+		return e, true
+	}
+	return Entry{}, false
+}
+
+// Rescan finds entries for the files at paths in root that were moved or renamed since they were hashed.
+// Entries from older caches are given a size and fingerprint.
+// It returns how many entries were reused for a file that would otherwise need to be hashed again.
+func (c *Cache) Rescan(root string, paths []string) int {
+	count := 0
+	for _, p := range paths {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(p)))
+		if err != nil {
+			continue
+		}
+		e, ok := c.Get(p)
+		if ok && e.ModTime == info.ModTime().Unix() && e.Size != 0 {
+			continue
+		}
+		size, fp, err := Fingerprint(filepath.Join(root, filepath.FromSlash(p)))
+		if err != nil {
+			continue
+		}
+		if ok && e.ModTime == info.ModTime().Unix() {
+			e.Size, e.Fingerprint = size, fp
+			c.Put(p, e)
+		} else if _, ok := c.Relocate(root, p, size, fp, info.ModTime().Unix()); ok {
+			count++
+		}
+	}
+	return count
+}
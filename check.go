@@ -0,0 +1,307 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/jlortiz0/ImageSort/cache"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+const (
+	CHECK_NEW = iota
+	CHECK_NEAR
+	CHECK_EXACT
+)
+
+// checkResult is whether an outside image is already in the library.
+type checkResult struct {
+	kind  int
+	match string
+	dist  int
+	entry cache.Entry
+}
+
+// CheckMenu browses a folder outside the library, such as a camera dump,
+// showing which images are already in the library. Only the library's cached hashes are searched.
+type CheckMenu struct {
+	ImageMenu
+	results map[string]checkResult
+}
+
+// matchLibrary finds the closest image in the library to an outside file.
+// A file with the same size and fingerprint is an exact duplicate, and one within the dupe sensitivity is a near duplicate.
+func matchLibrary(abs string, e cache.Entry) checkResult {
+	res := checkResult{entry: e}
+	usable := func(k string) bool {
+		return !inFolder(k, config.TrashFolder) && filepath.Join(library.root, filepath.FromSlash(k)) != abs
+	}
+	for _, k := range hashes.Lookup(e.Size, e.Fingerprint) {
+		if _, err := os.Stat(k); err == nil && usable(k) {
+			res.kind = CHECK_EXACT
+			res.match = k
+			return res
+		}
+	}
+	res.dist = len(e.Hash)*8 + 1
+	hashes.Range(func(k string, v cache.Entry) {
+		if !usable(k) || !compareBits(e.Hash, v.Hash) {
+			return
+		}
+		if d := hashDistance(e.Hash, v.Hash); d < res.dist || (d == res.dist && k < res.match) {
+			res.dist = d
+			res.match = k
+		}
+	})
+	if res.match != "" {
+		res.kind = CHECK_NEAR
+	}
+	return res
+}
+
+func makeCheckMenu(dir string) (*CheckMenu, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), nil))
+		return nil, quit
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		_, quit := displayMessage(wordWrapper(dir, []string{"Folder does not exist:"}))
+		return nil, quit
+	}
+	ls, _ := listImages(dir, true)
+	if len(ls) == 0 {
+		_, quit := displayMessage("Folder has no\nsupported images.")
+		return nil, quit
+	}
+	saveScreen()
+	texture, rect := drawMessage("Checking folder...\nPreparing...")
+	display.Clear()
+	display.Copy(texture, nil, rect)
+	fadeScreen()
+	lastUpdate := time.Now()
+	lastPump := time.Now()
+	results := make(map[string]checkResult, len(ls))
+	items := make([]string, 0, len(ls))
+	counts := make([]int, 3)
+	for i, v := range ls {
+		noteActivity()
+		p := filepath.Join(dir, filepath.FromSlash(v))
+		// Outside images are hashed without going through the cache, so it only holds library paths
+		size, fp, err := cache.Fingerprint(p)
+		var hsh []byte
+		var modTime int64
+		if err == nil {
+			hsh, modTime, err = computeHash(p)
+		}
+		if err == nil {
+			res := matchLibrary(p, cache.Entry{Hash: hsh, ModTime: modTime, Size: size, Fingerprint: fp})
+			results[v] = res
+			counts[res.kind]++
+			items = append(items, v)
+		}
+		if time.Since(lastUpdate) > time.Second/4 {
+			texture.Destroy()
+			texture, rect = drawMessage(fmt.Sprintf("Checking folder...\nHashing %.1f%%", float32(i)/float32(len(ls))*100))
+			display.Clear()
+			display.Copy(texture, nil, rect)
+			display.Present()
+			lastUpdate = time.Now()
+		}
+		if time.Since(lastPump) > time.Second/16 {
+			for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+				if keyEvent, ok := event.(*sdl.KeyboardEvent); ok && keyEvent.Keysym.Sym == sdl.K_ESCAPE {
+					texture.Destroy()
+					return nil, false
+				}
+			}
+			lastPump = time.Now()
+		}
+	}
+	texture.Destroy()
+	if len(items) == 0 {
+		_, quit := displayMessage("No images in the folder\ncould be hashed.")
+		return nil, quit
+	}
+	// Sorting by similarity would put outside paths in the cache
+	mode := config.SortMode
+	if mode == SORT_SIMILAR {
+		mode = SORT_NAME
+	}
+	sortImages(dir, items, mode, config.ReverseSort != 0)
+	menu := &CheckMenu{results: results}
+	menu.fldr = dir
+	menu.itemList = items
+	menu.sortMode = mode
+	menu.reverseSort = config.ReverseSort != 0
+	menu.recursive = true
+	menu.setNotice(fmt.Sprintf("%d exact, %d near, %d new", counts[CHECK_EXACT], counts[CHECK_NEAR], counts[CHECK_NEW]))
+	display.SetDrawColor(64, 64, 64, 0)
+	return menu, false
+}
+
+// checkFolder asks for a folder outside the library and opens a CheckMenu on it.
+func checkFolder() int {
+	dir := createNewFolder("")
+	if dir == "\x00" {
+		return LOOP_QUIT
+	} else if dir == "" {
+		return LOOP_CONT
+	}
+	menu, quit := makeCheckMenu(dir)
+	if quit {
+		return LOOP_QUIT
+	}
+	if menu == nil {
+		return LOOP_CONT
+	}
+	menu.imageLoader()
+	if stdEventLoop(menu) == LOOP_QUIT {
+		return LOOP_QUIT
+	}
+	menu.destroy()
+	return LOOP_CONT
+}
+
+// moveAll moves every image matching keep into target, and returns how many were moved.
+// Images moved into Sort keep the hash worked out for them.
+func (menu *CheckMenu) moveAll(target string, keep func(checkResult) bool) (int, error) {
+	menu.stopAnim()
+	count := 0
+	left := make([]string, 0, len(menu.itemList))
+	for _, v := range menu.itemList {
+		res := menu.results[v]
+		if !keep(res) {
+			left = append(left, v)
+			continue
+		}
+		newName, err := moveInto(filepath.Join(menu.fldr, filepath.FromSlash(v)), target)
+		if err != nil {
+			menu.itemList = append(left, menu.itemList[len(left)+count:]...)
+			return count, err
+		}
+		if target != config.TrashFolder {
+			p := path.Join(filepath.ToSlash(target), newName)
+			if info, err := os.Stat(p); err == nil {
+				res.entry.ModTime = info.ModTime().Unix()
+				hashes.Put(p, res.entry)
+			}
+		}
+		delete(menu.results, v)
+		count++
+	}
+	menu.itemList = left
+	return count, nil
+}
+
+func (menu *CheckMenu) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_o:
+		// Sorting by similarity would put outside paths in the cache
+		return LOOP_CONT
+	case sdl.K_t:
+		// Tags are only kept for images in the library
+		return LOOP_CONT
+	case sdl.K_m:
+		// Use the hash that was already worked out, instead of caching it
+		cur := menu.itemList[menu.Selected]
+		if browseSimilar(path.Join(filepath.ToSlash(menu.fldr), cur), menu.results[cur].entry.Hash) == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		saveScreen()
+		display.SetDrawColor(64, 64, 64, 0)
+		menu.renderer()
+		fadeScreen()
+		return LOOP_CONT
+	}
+	if sdl.GetModState()&sdl.KMOD_SHIFT == 0 || (key != sdl.K_c && key != sdl.K_x) {
+		return menu.ImageMenu.keyHandler(key)
+	}
+	// Shift + C discards every duplicate, Shift + X moves every new image to Sort
+	target, prompt := config.SortFolder, "Move every new image\nto "+config.SortFolder+"?\nZ - Yes  X - No"
+	keep := func(res checkResult) bool { return res.kind == CHECK_NEW }
+	if key == sdl.K_c {
+		target, prompt = config.TrashFolder, "Move every exact and near\nduplicate to "+config.TrashFolder+"?\nZ - Yes  X - No"
+		keep = func(res checkResult) bool { return res.kind != CHECK_NEW }
+	}
+	b, quit := displayMessage(prompt)
+	if quit {
+		return LOOP_QUIT
+	}
+	if b {
+		count, err := menu.moveAll(target, keep)
+		if err != nil {
+			if _, quit := displayMessage(wordWrapper(err.Error(), []string{"Error moving images:"})); quit {
+				return LOOP_QUIT
+			}
+		}
+		menu.setNotice(fmt.Sprintf("Moved %d images", count))
+		if menu.Selected >= len(menu.itemList) {
+			menu.Selected = len(menu.itemList) - 1
+		}
+		if len(menu.itemList) == 0 {
+			_, quit := displayMessage(fmt.Sprintf("Moved %d images.\nNothing is left to check.", count))
+			if quit {
+				return LOOP_QUIT
+			}
+			return LOOP_EXIT
+		}
+		menu.imageLoader()
+	}
+	saveScreen()
+	display.SetDrawColor(64, 64, 64, 0)
+	menu.renderer()
+	fadeScreen()
+	return LOOP_CONT
+}
+
+func (menu *CheckMenu) renderer() {
+	menu.ImageMenu.renderer()
+	if len(menu.itemList) == 0 {
+		return
+	}
+	cur := menu.itemList[menu.Selected]
+	res := menu.results[cur]
+	var text string
+	switch res.kind {
+	case CHECK_EXACT:
+		text = "Already in library: " + res.match
+	case CHECK_NEAR:
+		text = fmt.Sprintf("Near duplicate of %s (distance %d)", res.match, res.dist)
+	default:
+		text = "New: " + cur
+	}
+	surf, err := font.RenderUTF8Shaded(text, COLOR_BLACK, COLOR_WHITE)
+	if err != nil {
+		panic(err)
+	}
+	txt, _ := display.CreateTextureFromSurface(surf)
+	display.Copy(txt, nil, &sdl.Rect{H: surf.H, W: surf.W})
+	surf.Free()
+	txt.Destroy()
+}
+
+// The folder is only checked once, so a CheckMenu doesn't refresh
+func (menu *CheckMenu) refresh() int {
+	return LOOP_CONT
+}
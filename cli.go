@@ -0,0 +1,515 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/jlortiz0/ImageSort/cache"
+)
+
+// Set with -ldflags "-X main.version=..." when building a release
+var version = "devel"
+
+var cliArgs struct {
+	root       string
+	folder     string
+	mode       string
+	fullscreen bool
+}
+
+// subcommands are headless tools that run instead of the UI.
+// cleanup and spacecnt were separate tools before the cache commands existed.
+var subcommands = map[string]func([]string) error{
+	"cache":    cacheCommand,
+	"import":   importFolderCommand,
+	"cleanup":  pruneCommand,
+	"spacecnt": statsCommand,
+}
+
+var cacheCommands = map[string]func([]string) error{
+	"prune":  pruneCommand,
+	"stats":  statsCommand,
+	"verify": verifyCommand,
+	"rehash": rehashCommand,
+	"export": exportCommand,
+	"import": importCommand,
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options] [library]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(out, "       %s [--config file] [--cache file] <command> [command options] [library]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  cache     maintain the hash cache: prune, stats, verify, rehash, export, import")
+	fmt.Fprintln(out, "  import    bring new images from a folder into the Sort folder")
+	fmt.Fprintln(out, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+func getVersion() string {
+	if version == "devel" {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+	}
+	return version
+}
+
+// parseArgs handles the command line. If a subcommand was run, or only the version was asked for, it returns true.
+// The options come before the subcommand, so --config and --cache apply to it too.
+func parseArgs() bool {
+	flag.Usage = usage
+	configPath := flag.String("config", "", "path to the config file (default: ImgSort.cfg in the library)")
+	cachePath := flag.String("cache", "", "path to the hash cache (default: imgSort.cache in the library)")
+	flag.StringVar(&cliArgs.folder, "folder", "", "folder to open, relative to the library")
+	flag.StringVar(&cliArgs.mode, "mode", "", "menu to open on startup: sort, trash, dedup or browse")
+	flag.BoolVar(&cliArgs.fullscreen, "fullscreen", false, "start in fullscreen")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("ImageSort", getVersion())
+		return true
+	}
+	// These have to be made absolute before changing to the library root
+	if *configPath != "" {
+		library.configPath, _ = filepath.Abs(*configPath)
+	}
+	if *cachePath != "" {
+		library.cachePath, _ = filepath.Abs(*cachePath)
+	}
+	if cmd, ok := subcommands[flag.Arg(0)]; ok {
+		if cliArgs.mode != "" || cliArgs.folder != "" || cliArgs.fullscreen {
+			fmt.Fprintln(os.Stderr, "--mode, --folder and --fullscreen can't be used with "+flag.Arg(0))
+			os.Exit(2)
+		}
+		err := cmd(flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return true
+	}
+	switch cliArgs.mode {
+	case "":
+		// A folder on its own is opened in the image browser
+		if cliArgs.folder != "" {
+			cliArgs.mode = "browse"
+		}
+	case "sort", "trash":
+		if cliArgs.folder != "" {
+			fmt.Fprintln(os.Stderr, "--folder can't be used with --mode "+cliArgs.mode)
+			os.Exit(2)
+		}
+	case "dedup":
+	case "browse":
+		if cliArgs.folder == "" {
+			fmt.Fprintln(os.Stderr, "--mode browse needs --folder")
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown mode "+cliArgs.mode)
+		os.Exit(2)
+	}
+	cliArgs.root = strings.Join(flag.Args(), " ")
+	cliArgs.folder = filepath.ToSlash(cliArgs.folder)
+	return false
+}
+
+// startMode opens the menu asked for on the command line, if any, before the folder menu is shown.
+func startMode() bool {
+	var men ImageBrowser
+	var quit bool
+	if cliArgs.folder != "" {
+		if info, err := os.Stat(cliArgs.folder); err != nil || !info.IsDir() {
+			_, quit = displayMessage("Folder " + cliArgs.folder + "\ndoes not exist.")
+			return quit
+		}
+	}
+	switch cliArgs.mode {
+	case "sort":
+		var imgMenu *SortMenu
+		imgMenu, quit = makeSortMenu(sortTargets())
+		if imgMenu != nil {
+			men = imgMenu
+		}
+	case "trash":
+		var imgMenu *TrashMenu
+		imgMenu, quit = makeTrashMenu()
+		if imgMenu != nil {
+			men = imgMenu
+		}
+	case "browse":
+		var imgMenu *ImageMenu
+		imgMenu, quit = makeImageMenu(cliArgs.folder, false)
+		if imgMenu != nil {
+			men = imgMenu
+		}
+	case "dedup":
+		var imgMenu *DiffMenu
+		if cliArgs.folder != "" {
+			imgMenu, quit = makeDiffMenu(cliArgs.folder)
+		} else {
+			imgMenu, quit = makeDiffAllMenu()
+		}
+		if imgMenu != nil {
+			result := imgMenu.initDiff()
+			if result == LOOP_QUIT {
+				return true
+			} else if result == LOOP_EXIT {
+				_, quit = displayMessage("No duplicates!")
+			} else {
+				men = imgMenu
+			}
+		}
+	}
+	if quit {
+		return true
+	}
+	if men == nil {
+		return false
+	}
+	men.imageLoader()
+	if stdEventLoop(men) == LOOP_QUIT {
+		return true
+	}
+	men.destroy()
+	return false
+}
+
+// openLibraryHeadless opens a library for a subcommand, without asking which one.
+func openLibraryHeadless(args []string) error {
+	root := strings.Join(args, " ")
+	if root == "" {
+		root = "."
+	}
+	setDefaultConfig()
+	err := openLibrary(root)
+	if err != nil {
+		return err
+	}
+	return loadConfig()
+}
+
+func cacheCommand(args []string) error {
+	if len(args) == 0 {
+		cacheUsage()
+		os.Exit(2)
+	}
+	cmd, ok := cacheCommands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown cache command "+args[0])
+		cacheUsage()
+		os.Exit(2)
+	}
+	return cmd(args[1:])
+}
+
+func cacheUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s cache <command> [options] [library]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  prune    follow moved files and remove entries for missing or modified files")
+	fmt.Fprintln(os.Stderr, "  stats    show how much of the cache each folder takes up")
+	fmt.Fprintln(os.Stderr, "  verify   list entries for missing or modified files without changing anything")
+	fmt.Fprintln(os.Stderr, "  rehash   hash every file in the cache again with the current settings")
+	fmt.Fprintln(os.Stderr, "  export   write the cache as JSON lines or CSV")
+	fmt.Fprintln(os.Stderr, "  import   merge entries written by export into the cache")
+}
+
+func pruneCommand(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	dry := fs.Bool("n", false, "only list the entries that would be removed")
+	fs.Parse(args)
+	err := openLibraryHeadless(fs.Args())
+	if err != nil {
+		return err
+	}
+	err = loadHashes()
+	if err != nil {
+		return err
+	}
+	// Find files that were moved before throwing out their entries
+	ls, _ := listImages(".", true)
+	relocated := hashes.Rescan(".", ls)
+	removed := hashes.Prune(".")
+	for _, v := range removed {
+		fmt.Println(v.Path)
+	}
+	if relocated != 0 {
+		fmt.Fprintf(os.Stderr, "Kept %d entries for moved files\n", relocated)
+	}
+	if !*dry {
+		return saveHashes()
+	}
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+	err := openLibraryHeadless(fs.Args())
+	if err != nil {
+		return err
+	}
+	err = loadHashes()
+	if err != nil {
+		return err
+	}
+	problems := hashes.Verify(".")
+	for _, v := range problems {
+		fmt.Printf("%s: %s\n", v.Path, v.Reason)
+	}
+	fmt.Printf("%d entries, %d problems\n", hashes.Len(), len(problems))
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func rehashCommand(args []string) error {
+	fs := flag.NewFlagSet("rehash", flag.ExitOnError)
+	fs.Parse(args)
+	err := openLibraryHeadless(fs.Args())
+	if err != nil {
+		return err
+	}
+	// Accept a cache of any hash size, since changing it is the main reason to rehash
+	hashes, err = cache.Load(library.cachePath, 0)
+	if err != nil {
+		return err
+	}
+	hashes.HashSize = byte(config.HashSize)
+	failed := hashes.Rehash(".", computeHash, func(i, total int) {
+		fmt.Fprintf(os.Stderr, "\r%d/%d", i, total)
+	})
+	fmt.Fprintln(os.Stderr)
+	for _, v := range failed {
+		fmt.Printf("%s: %s\n", v.Path, v.Reason)
+	}
+	return saveHashes()
+}
+
+// exportFormat picks the format for export and import. Without -f, it goes by the file extension.
+func exportFormat(format, name string) string {
+	if format == "" && strings.EqualFold(filepath.Ext(name), ".csv") {
+		return cache.FORMAT_CSV
+	} else if format == "" {
+		return cache.FORMAT_JSON
+	}
+	return strings.ToLower(format)
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "file to write to (default: standard output)")
+	format := fs.String("f", "", "json or csv (default: csv if the file ends in .csv, otherwise json)")
+	fs.Parse(args)
+	*format = exportFormat(*format, *out)
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "" {
+		// Create before changing to the library, in case the path is relative
+		var err error
+		f, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	err := openLibraryHeadless(fs.Args())
+	if err != nil {
+		return err
+	}
+	err = loadHashes()
+	if err != nil {
+		return err
+	}
+	err = hashes.Export(w, *format)
+	if err == nil && f != nil {
+		err = f.Close()
+	}
+	return err
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("i", "", "file to read from (default: standard input)")
+	format := fs.String("f", "", "json or csv (default: csv if the file ends in .csv, otherwise json)")
+	fs.Parse(args)
+	*format = exportFormat(*format, *in)
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		// Open before changing to the library, in case the path is relative
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	err := openLibraryHeadless(fs.Args())
+	if err != nil {
+		return err
+	}
+	err = loadHashes()
+	if err != nil {
+		return err
+	}
+	merged, skipped, err := hashes.Import(r, *format)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d entries, skipped %d that were older or had a different hash size\n", merged, skipped)
+	return saveHashes()
+}
+
+func importFolderCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dry := fs.Bool("n", false, "only list what would be imported")
+	move := fs.Bool("m", false, "move files instead of copying them (default: the Import Moves Files option)")
+	rename := fs.String("r", "", "rename files with this pattern, such as %Y-%m-%d_%H%M%S (default: ImportRename in the config)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [options] <source> [library]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	// Made absolute before changing to the library, in case the path is relative
+	src, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	err = openLibraryHeadless(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	err = loadHashes()
+	if err != nil {
+		return err
+	}
+	src, err = checkImportSource(src)
+	if err != nil {
+		return err
+	}
+	pattern := config.ImportRename
+	if *rename != "" {
+		pattern = *rename
+	}
+	results, err := importFolder(src, *move || config.ImportMove != 0, *dry, pattern, nil)
+	if err != nil {
+		return err
+	}
+	for _, v := range results {
+		if v.err != nil {
+			fmt.Printf("%s\t%s\t%s\n", importActions[v.action], v.src, v.err)
+		} else {
+			fmt.Printf("%s\t%s\t%s\n", importActions[v.action], v.src, v.dest)
+		}
+	}
+	counts := importCounts(results)
+	fmt.Fprintf(os.Stderr, "%d imported, %d already in library, %d failed\n", counts[IMPORT_COPIED]+counts[IMPORT_MOVED], counts[IMPORT_DUPLICATE], counts[IMPORT_FAILED])
+	if *dry {
+		return nil
+	}
+	return writeImportLog(src, results)
+}
+
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	csv := fs.Bool("c", false, "output data in csv format")
+	alpha := fs.Bool("a", false, "sort alphabetically instead of by value")
+	rev := fs.Bool("r", false, "sort descending instead of ascending")
+	pad := fs.Bool("x", false, "include padding total")
+	per := fs.Bool("p", false, "show as percent of file per folder")
+	nterm := fs.Bool("n", false, "include null terminator as part of folder counts")
+	fPath := fs.String("i", "", "path to cache file (default: imgSort.cache in the library)")
+	fs.Parse(args)
+	if *fPath == "" {
+		err := openLibraryHeadless(fs.Args())
+		if err != nil {
+			return err
+		}
+		*fPath = library.cachePath
+	}
+	f, err := os.Open(*fPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fSize := float32(stat.Size())
+	folders, err := cache.Stats(f, *nterm)
+	if err != nil {
+		return err
+	}
+	if !(*pad) {
+		delete(folders, "(padding)")
+	}
+	names := make([]string, 0, len(folders))
+	for k := range folders {
+		names = append(names, k)
+	}
+	if *alpha {
+		if *rev {
+			sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		} else {
+			sort.Strings(names)
+		}
+	} else {
+		if *rev {
+			sort.Slice(names, func(i, j int) bool {
+				return folders[names[i]] > folders[names[j]]
+			})
+		} else {
+			sort.Slice(names, func(i, j int) bool {
+				return folders[names[i]] < folders[names[j]]
+			})
+		}
+	}
+	s := "%-24s"
+	if *csv {
+		s = "%s,"
+	}
+	if *per {
+		s += "%.2f%%\n"
+	} else {
+		s += "%d\n"
+	}
+	for _, v := range names {
+		if *per {
+			fmt.Printf(s, v, float32(folders[v])/fSize*100)
+		} else {
+			fmt.Printf(s, v, folders[v])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/veandco/go-sdl2/img"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Ways the deduplicator can show a pair
+const (
+	COMPARE_SINGLE = iota
+	COMPARE_SIDE
+	COMPARE_BLINK
+	COMPARE_OVERLAY
+	COMPARE_DIFF
+)
+
+var compareModeNames = []string{"One at a time", "Side by side", "Blink", "Overlay", "Difference"}
+
+// How long each image is shown for when blinking
+const blinkInterval = 600 * time.Millisecond
+
+// The difference heatmap is worked out at no more than this many pixels across
+const maxHeatmapSize = 2048
+
+// fitRect is where an image of size w by h goes to fill area without changing its shape.
+func fitRect(w, h int32, area sdl.Rect) sdl.Rect {
+	var sx, sy int32
+	if h*area.W >= w*area.H {
+		sy = area.H
+		sx = area.H * w / h
+	} else {
+		sx = area.W
+		sy = area.W * h / w
+	}
+	return sdl.Rect{X: area.X + (area.W-sx)/2, Y: area.Y + (area.H-sy)/2, W: sx, H: sy}
+}
+
+// mapRect moves the zoom and pan of pos, relative to the fitted rect from, onto the fitted rect to.
+// This keeps images of different sizes lined up with each other.
+func mapRect(pos, from, to sdl.Rect) *sdl.Rect {
+	if from.W == 0 || from.H == 0 {
+		return &to
+	}
+	return &sdl.Rect{
+		X: to.X + int32(int64(pos.X-from.X)*int64(to.W)/int64(from.W)),
+		Y: to.Y + int32(int64(pos.Y-from.Y)*int64(to.H)/int64(from.H)),
+		W: int32(int64(pos.W) * int64(to.W) / int64(from.W)),
+		H: int32(int64(pos.H) * int64(to.H) / int64(from.H)),
+	}
+}
+
+// textureFit is fitRect for a texture.
+func textureFit(tex *sdl.Texture, area sdl.Rect) sdl.Rect {
+	_, _, w, h, _ := tex.Query()
+	if w < 1 || h < 1 {
+		return area
+	}
+	return fitRect(w, h, area)
+}
+
+// pairTextures returns the textures of the first and second image of the pair, whichever one is being viewed.
+func (menu *DiffMenu) pairTextures() [2]*sdl.Texture {
+	if menu.imageSel == 0 {
+		return [2]*sdl.Texture{menu.image, menu.image2}
+	}
+	return [2]*sdl.Texture{menu.image2, menu.image}
+}
+
+// drawCompare draws the pair in the current compare mode. The zoom and pan of the image being viewed are used for both.
+func (menu *DiffMenu) drawCompare() {
+	if menu.compare == COMPARE_SINGLE || menu.image2 == nil {
+		display.Copy(menu.image, nil, menu.pos)
+		return
+	}
+	// The other image only plays when it can be seen
+	if menu.ffmpeg2 != nil {
+		b, _, err := menu.image2.Lock(nil)
+		if err == nil {
+			menu.ffmpeg2.Read(b)
+			menu.image2.Unlock()
+		}
+	}
+	vp := display.GetViewport()
+	full := sdl.Rect{W: vp.W, H: vp.H}
+	curFit := textureFit(menu.image, full)
+	pair := menu.pairTextures()
+	switch menu.compare {
+	case COMPARE_SIDE:
+		for k, tex := range pair {
+			half := sdl.Rect{X: int32(k) * vp.W / 2, W: vp.W / 2, H: vp.H}
+			display.SetClipRect(&half)
+			display.Copy(tex, nil, mapRect(*menu.pos, curFit, textureFit(tex, half)))
+			if k == menu.imageSel {
+				display.SetDrawColor(0xC1, 0xDD, 0xF3, 0)
+				display.DrawRect(&sdl.Rect{X: half.X + 1, Y: half.Y + 1, W: half.W - 2, H: half.H - 2})
+			}
+		}
+		display.SetClipRect(nil)
+		menu.resetDrawColor()
+	case COMPARE_BLINK:
+		tex := pair[(time.Now().UnixMilli()/blinkInterval.Milliseconds())%2]
+		display.Copy(tex, nil, mapRect(*menu.pos, curFit, textureFit(tex, full)))
+	case COMPARE_OVERLAY:
+		display.Copy(pair[0], nil, mapRect(*menu.pos, curFit, textureFit(pair[0], full)))
+		// Video textures don't blend unless told to
+		mode, _ := pair[1].GetBlendMode()
+		pair[1].SetBlendMode(sdl.BLENDMODE_BLEND)
+		pair[1].SetAlphaMod(128)
+		display.Copy(pair[1], nil, mapRect(*menu.pos, curFit, textureFit(pair[1], full)))
+		pair[1].SetAlphaMod(255)
+		pair[1].SetBlendMode(mode)
+	case COMPARE_DIFF:
+		if menu.heatmap == nil {
+			display.Copy(menu.image, nil, menu.pos)
+			return
+		}
+		display.Copy(menu.heatmap, nil, mapRect(*menu.pos, curFit, textureFit(menu.heatmap, full)))
+	}
+}
+
+// resetDrawColor sets the background back to the one for the image being viewed.
+func (menu *DiffMenu) resetDrawColor() {
+	if menu.imageSel == 0 {
+		display.SetDrawColor(64, 64, 64, 0)
+	} else {
+		display.SetDrawColor(40, 40, 40, 0)
+	}
+}
+
+// renderCompareLabels says which image is which, or how different they are in the difference view.
+func (menu *DiffMenu) renderCompareLabels() {
+	if len(menu.diffList) == 0 || menu.compare == COMPARE_SINGLE {
+		return
+	}
+	var y int32
+	if menu.tagging || (menu.bar != nil && menu.bar.show && len(menu.bar.folders) != 0) {
+		y = barHeight()
+	}
+	pair := menu.diffList[menu.Selected]
+	vp := display.GetViewport()
+	label := func(s string, x int32) {
+		surf, err := font.RenderUTF8Shaded(s, COLOR_BLACK, COLOR_WHITE)
+		if err != nil {
+			panic(err)
+		}
+		txt, _ := display.CreateTextureFromSurface(surf)
+		display.Copy(txt, nil, &sdl.Rect{X: x, Y: y, H: surf.H, W: surf.W})
+		surf.Free()
+		txt.Destroy()
+	}
+	switch menu.compare {
+	case COMPARE_SIDE:
+		label("A: "+pair[0], 0)
+		label("B: "+pair[1], vp.W/2)
+	case COMPARE_BLINK:
+		k := (time.Now().UnixMilli() / blinkInterval.Milliseconds()) % 2
+		label(fmt.Sprintf("%c: %s", 'A'+k, pair[k]), 0)
+	case COMPARE_OVERLAY:
+		label("A: "+pair[0]+"  B (faded): "+pair[1], 0)
+	case COMPARE_DIFF:
+		if menu.heatmap != nil {
+			label(fmt.Sprintf("Average difference: %.1f%%", menu.heatmapMean*100), 0)
+		}
+	}
+}
+
+// setCompare changes the compare mode.
+func (menu *DiffMenu) setCompare(mode int) int {
+	menu.compare = mode
+	menu.setNotice("Compare: " + compareModeNames[mode])
+	if mode == COMPARE_DIFF && menu.heatmap == nil {
+		return menu.loadHeatmap()
+	}
+	return LOOP_CONT
+}
+
+// loadHeatmap works out the difference heatmap of the current pair. Animations and videos fall back to one image at a time.
+func (menu *DiffMenu) loadHeatmap() int {
+	if menu.ffmpeg != nil || menu.ffmpeg2 != nil {
+		menu.setNotice("Difference only works on still images")
+		return LOOP_CONT
+	}
+	pair := menu.diffList[menu.Selected]
+	var err error
+	menu.heatmap, menu.heatmapMean, err = diffHeatmap(filepath.Join(menu.fldr, pair[0]), filepath.Join(menu.fldr, pair[1]))
+	if err != nil {
+		if _, quit := displayMessage(wordWrapper(err.Error(), []string{"Could not compare images:"})); quit {
+			return LOOP_QUIT
+		}
+	}
+	return LOOP_CONT
+}
+
+// clearHeatmap throws out the heatmap when the pair changes.
+func (menu *DiffMenu) clearHeatmap() {
+	if menu.heatmap != nil {
+		menu.heatmap.Destroy()
+		menu.heatmap = nil
+	}
+}
+
+// loadRGBA loads an image as 32-bit RGBA pixels.
+func loadRGBA(p string) (*sdl.Surface, error) {
+	surf, err := img.Load(p)
+	if err != nil {
+		return nil, err
+	}
+	defer surf.Free()
+	return surf.ConvertFormat(uint32(sdl.PIXELFORMAT_RGBA32), 0)
+}
+
+// diffHeatmap shows how different two images are at each pixel. The second image is stretched to the size of the first.
+// Pixels that are the same are black, and the more different they are, the closer to white they get, through red and yellow.
+// It also returns the average difference, from 0 to 1.
+func diffHeatmap(a, b string) (*sdl.Texture, float64, error) {
+	surfA, err := loadRGBA(a)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer surfA.Free()
+	surfB, err := loadRGBA(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer surfB.Free()
+	w, h := surfA.W, surfA.H
+	if w > maxHeatmapSize || h > maxHeatmapSize {
+		r := fitRect(w, h, sdl.Rect{W: maxHeatmapSize, H: maxHeatmapSize})
+		w, h = max(r.W, 1), max(r.H, 1)
+	}
+	// Both images are scaled onto surfaces of the same size, so their pixels line up
+	var scaled [2]*sdl.Surface
+	for k, src := range []*sdl.Surface{surfA, surfB} {
+		scaled[k], err = sdl.CreateRGBSurfaceWithFormat(0, w, h, 32, uint32(sdl.PIXELFORMAT_RGBA32))
+		if err != nil {
+			return nil, 0, err
+		}
+		defer scaled[k].Free()
+		src.SetBlendMode(sdl.BLENDMODE_NONE)
+		err = src.BlitScaled(nil, scaled[k], &sdl.Rect{W: w, H: h})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	out, err := sdl.CreateRGBSurfaceWithFormat(0, w, h, 32, uint32(sdl.PIXELFORMAT_RGBA32))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer out.Free()
+	scaled[0].Lock()
+	scaled[1].Lock()
+	out.Lock()
+	pxA, pxB, pxOut := scaled[0].Pixels(), scaled[1].Pixels(), out.Pixels()
+	var total float64
+	for y := 0; y < int(h); y++ {
+		rowA := pxA[y*int(scaled[0].Pitch):]
+		rowB := pxB[y*int(scaled[1].Pitch):]
+		rowOut := pxOut[y*int(out.Pitch):]
+		for x := 0; x < int(w); x++ {
+			i := x * 4
+			d := 0
+			for c := 0; c < 3; c++ {
+				d += absInt(int(rowA[i+c]) - int(rowB[i+c]))
+			}
+			// 0 to 765, spread over black, red, yellow and white
+			total += float64(d) / 765
+			rowOut[i] = byte(min(d*3, 255))
+			rowOut[i+1] = byte(clampInt(d*3-255, 0, 255))
+			rowOut[i+2] = byte(clampInt(d*3-510, 0, 255))
+			rowOut[i+3] = 255
+		}
+	}
+	out.Unlock()
+	scaled[1].Unlock()
+	scaled[0].Unlock()
+	tex, err := display.CreateTextureFromSurface(out)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tex, total / float64(w*h), nil
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func clampInt(x, lower, upper int) int {
+	return min(max(x, lower), upper)
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 )
 
 func hideConsole() {}
@@ -18,3 +19,15 @@ func highlightFile(p1, _ string) {
 func viewFile(p string) {
 	go exec.Command("xdg-open", p).Run()
 }
+
+// linkCount is how many hard links the file at p has.
+func linkCount(p string) uint64 {
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
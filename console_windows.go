@@ -31,3 +31,21 @@ func highlightFile(p1, p2 string) {
 func viewFile(p string) {
 	exec.Command("rundll32.exe", "url.dll,FileProtocolHandler", p).Run()
 }
+
+// linkCount is how many hard links the file at p has.
+func linkCount(p string) uint64 {
+	name, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return 0
+	}
+	h, err := windows.CreateFile(name, 0, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0
+	}
+	defer windows.CloseHandle(h)
+	var info windows.ByHandleFileInformation
+	if windows.GetFileInformationByHandle(h, &info) != nil {
+		return 0
+	}
+	return uint64(info.NumberOfLinks)
+}
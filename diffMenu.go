@@ -19,11 +19,8 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"image"
-	"io"
 	"math/bits"
 	"os"
 	"path"
@@ -32,26 +29,30 @@ import (
 	"time"
 
 	"github.com/devedge/imagehash"
+	"github.com/jlortiz0/ImageSort/cache"
 	"github.com/jlortiz0/multisav/streamy"
 	"github.com/veandco/go-sdl2/sdl"
 )
 
 // Use path for keys to hashes, not filepath
 // This allows them to be portable across OSes
-var hashes map[string]hashEntry
-
-type hashEntry struct {
-	hash    []byte
-	modTime int64
-}
+var hashes *cache.Cache
 
 type DiffMenu struct {
 	image2   *sdl.Texture
 	pos2     *sdl.Rect
 	ffmpeg2  *StreamyWrapper
 	diffList [][2]string
+	// Unfiltered pair list, nil if there is no filter
+	allPairs [][2]string
 	ImageMenu
 	imageSel int
+	// How the pair is shown, one of the COMPARE_ constants
+	compare     int
+	heatmap     *sdl.Texture
+	heatmapMean float64
+	// Measurements of each image, see getQuality
+	quality map[string]Quality
 }
 
 func makeDiffMenu(fldr string) (*DiffMenu, bool) {
@@ -98,6 +99,10 @@ func makeDiffMenu(fldr string) (*DiffMenu, bool) {
 	}
 	menu.itemList = ls
 	menu.fldr = fldr
+	if config.FolderBarAll != 0 {
+		menu.bar = makeFolderBar(barTargets(fldr))
+	}
+	menu.drawImage = menu.drawCompare
 	display.SetDrawColor(64, 64, 64, 0)
 	return menu, false
 }
@@ -120,6 +125,7 @@ func (menu *DiffMenu) initDiff() int {
 	failed := make([]hashErr, 0, 10)
 	var err error
 	for k, v := range menu.itemList {
+		noteActivity()
 		if menu.fldr == "." {
 			diffLs[k], err = getHash(v)
 			if os.PathSeparator != '/' {
@@ -152,11 +158,21 @@ func (menu *DiffMenu) initDiff() int {
 			lastPump = time.Now()
 		}
 	}
+	// Fingerprints are only needed for pairs that might be ignored
+	fingerprints := make([]string, len(menu.itemList))
+	fingerprint := func(i int) string {
+		if fingerprints[i] == "" {
+			fingerprints[i] = fingerprintKey(filepath.Join(menu.fldr, menu.itemList[i]))
+		}
+		return fingerprints[i]
+	}
 	for i, v := range diffLs {
 		j := i + 1
 		for j < len(diffLs) {
-			if compareBits(v, diffLs[j]) {
-				menu.diffList = append(menu.diffList, [2]string{menu.itemList[i], menu.itemList[j]})
+			if compareBits(v, diffLs[j]) && !sameFile(filepath.Join(menu.fldr, menu.itemList[i]), filepath.Join(menu.fldr, menu.itemList[j])) {
+				if len(ignored.pairs) == 0 || !ignored.Has(fingerprint(i), fingerprint(j)) {
+					menu.diffList = append(menu.diffList, [2]string{menu.itemList[i], menu.itemList[j]})
+				}
 			}
 			j++
 		}
@@ -196,6 +212,20 @@ func (menu *DiffMenu) initDiff() int {
 }
 
 func (menu *DiffMenu) keyHandler(key sdl.Keycode) int {
+	// Q switches images here, so the bars' pages are changed with Tab
+	if key != sdl.K_q {
+		if ret, ok := menu.tagKeys(key); ok {
+			return ret
+		}
+		if menu.bar != nil && !menu.tagging {
+			target, ret, ok := menu.bar.keyHandler(key)
+			if target != "" {
+				return menu.bar.moveTo(menu, filepath.Join(menu.fldr, menu.diffList[menu.Selected][menu.imageSel]), target)
+			} else if ok {
+				return ret
+			}
+		}
+	}
 	switch key {
 	case sdl.K_u:
 		posBak := menu.pos.X
@@ -235,8 +265,10 @@ func (menu *DiffMenu) keyHandler(key sdl.Keycode) int {
 		}
 		temp := filepath.Join(menu.fldr, fmt.Sprintf("%d.tmp", time.Now().Unix()))
 		a := menu.diffList[menu.Selected]
+		moveLock.Lock()
 		err := os.Rename(filepath.Join(menu.fldr, a[menu.imageSel]), temp)
 		if err != nil {
+			moveLock.Unlock()
 			break
 		}
 		err = os.Rename(filepath.Join(menu.fldr, a[menu.imageSel^1]), filepath.Join(menu.fldr, a[menu.imageSel]))
@@ -250,10 +282,15 @@ func (menu *DiffMenu) keyHandler(key sdl.Keycode) int {
 		if err != nil {
 			panic(err)
 		}
-		temp2 := hashes[path.Join(menu.fldr, a[menu.imageSel])]
-		hashes[path.Join(menu.fldr, a[menu.imageSel])] = hashes[path.Join(menu.fldr, a[menu.imageSel^1])]
-		hashes[path.Join(menu.fldr, a[menu.imageSel^1])] = temp2
-		if menu.animated {
+		hashes.Swap(path.Join(menu.fldr, a[menu.imageSel]), path.Join(menu.fldr, a[menu.imageSel^1]))
+		moveLock.Unlock()
+		tags.Swap(path.Join(menu.fldr, a[menu.imageSel]), path.Join(menu.fldr, a[menu.imageSel^1]))
+		ratings.Swap(path.Join(menu.fldr, a[menu.imageSel]), path.Join(menu.fldr, a[menu.imageSel^1]))
+		swapSidecars(filepath.Join(menu.fldr, a[menu.imageSel]), filepath.Join(menu.fldr, a[menu.imageSel^1]))
+		delete(menu.quality, a[0])
+		delete(menu.quality, a[1])
+		menu.clearHeatmap()
+		if menu.animated || menu.compare == COMPARE_DIFF {
 			menu.shouldReload = true
 		}
 	case sdl.K_q:
@@ -263,15 +300,72 @@ func (menu *DiffMenu) keyHandler(key sdl.Keycode) int {
 		menu.ffmpeg, menu.ffmpeg2 = menu.ffmpeg2, menu.ffmpeg
 		menu.animated = menu.ffmpeg != nil
 		menu.itemList[menu.Selected] = menu.diffList[menu.Selected][menu.imageSel]
-		if menu.imageSel == 0 {
-			display.SetDrawColor(64, 64, 64, 0)
-		} else {
-			display.SetDrawColor(40, 40, 40, 0)
-		}
+		if menu.compare != COMPARE_SINGLE {
+			// Both images are on screen, so keep them zoomed the same when switching
+			vp := display.GetViewport()
+			full := sdl.Rect{W: vp.W, H: vp.H}
+			menu.pos = mapRect(*menu.pos2, textureFit(menu.image2, full), textureFit(menu.image, full))
+		}
+		menu.resetDrawColor()
+	case sdl.K_b:
+		mode := menu.compare + 1
+		if sdl.GetModState()&sdl.KMOD_SHIFT != 0 {
+			mode = menu.compare + len(compareModeNames) - 1
+		}
+		return menu.setCompare(mode % len(compareModeNames))
+	case sdl.K_n:
+		return menu.ignorePair()
+	case sdl.K_k:
+		ret := menu.resolveDuplicates()
+		if ret != LOOP_CONT {
+			return ret
+		}
+		saveScreen()
+		menu.renderer()
+		fadeScreen()
 	case sdl.K_x:
-		return moveFile(menu, filepath.Join(menu.fldr, menu.diffList[menu.Selected][menu.imageSel]), "Sort")
+		return moveFile(menu, filepath.Join(menu.fldr, menu.diffList[menu.Selected][menu.imageSel]), config.SortFolder)
 	case sdl.K_c:
-		return moveFile(menu, filepath.Join(menu.fldr, menu.diffList[menu.Selected][menu.imageSel]), "Trash")
+		return moveFile(menu, filepath.Join(menu.fldr, menu.diffList[menu.Selected][menu.imageSel]), config.TrashFolder)
+	case sdl.K_m:
+		if browseSimilar(filepath.ToSlash(filepath.Join(menu.fldr, menu.diffList[menu.Selected][menu.imageSel])), nil) == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		ret := menu.imageLoader()
+		if ret != LOOP_CONT {
+			return ret
+		}
+		saveScreen()
+		menu.renderer()
+		fadeScreen()
+	case sdl.K_o:
+		// The pair list isn't sorted by file, so sort modes don't apply
+	case sdl.K_f:
+		pairs := menu.diffList
+		if menu.allPairs != nil {
+			pairs = menu.allPairs
+		}
+		items := make([]string, 0, len(pairs)*2)
+		for _, v := range pairs {
+			items = append(items, v[0], v[1])
+		}
+		old := menu.filter
+		str := promptFilter(menu.filter, menu.fldr, items, menu, menu.previewFilter)
+		if str == "\x00" {
+			return LOOP_QUIT
+		}
+		if str != menu.filter {
+			ok, quit := menu.applyFilter(str)
+			if quit {
+				return LOOP_QUIT
+			} else if !ok {
+				// Put back what was there before the prompt, not the last filter that was previewed
+				menu.previewFilter(old)
+			}
+		}
+		saveScreen()
+		menu.renderer()
+		fadeScreen()
 	case sdl.K_g:
 		sel := menu.Selected
 		ret := menu.ImageMenu.keyHandler(sdl.K_g)
@@ -285,12 +379,99 @@ func (menu *DiffMenu) keyHandler(key sdl.Keycode) int {
 	return LOOP_CONT
 }
 
+// filterCandidates asks for a filter and narrows the images to be hashed to the ones that match.
+func (menu *DiffMenu) filterCandidates() (bool, bool) {
+	str := promptFilter("", menu.fldr, menu.itemList, nil, nil)
+	if str == "\x00" {
+		return false, true
+	} else if str == "" {
+		return true, false
+	}
+	f, err := parseFilter(str)
+	if err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), []string{"Invalid filter:"}))
+		return false, quit
+	}
+	menu.itemList = f.apply(menu.fldr, menu.itemList)
+	if len(menu.itemList) == 0 {
+		_, quit := displayMessage("No images match\n" + str)
+		return false, quit
+	}
+	return true, false
+}
+
+// applyFilter keeps the pairs where either image matches str, or removes the filter if str is empty.
+func (menu *DiffMenu) applyFilter(str string) (bool, bool) {
+	f, err := parseFilter(str)
+	if err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), []string{"Invalid filter:"}))
+		return false, quit
+	}
+	if !menu.setFilter(str, f) {
+		_, quit := displayMessage("No pairs match\n" + str)
+		return false, quit
+	}
+	return true, false
+}
+
+// previewFilter is applyFilter without any messages, for filtering while the filter is typed.
+func (menu *DiffMenu) previewFilter(str string) bool {
+	f, err := parseFilter(str)
+	return err == nil && menu.setFilter(str, f)
+}
+
+// setFilter keeps the pairs where either image matches f, keeping the current pair selected if it matches.
+// If no pairs match, the list is left alone and false is returned.
+func (menu *DiffMenu) setFilter(str string, f *imageFilter) bool {
+	all := menu.allPairs
+	if all == nil {
+		all = menu.diffList
+	}
+	var cur [2]string
+	if len(menu.diffList) != 0 {
+		cur = menu.diffList[menu.Selected]
+	}
+	if str == "" {
+		menu.diffList = all
+		menu.allPairs = nil
+	} else {
+		ls := make([][2]string, 0, len(all))
+		for _, v := range all {
+			if f.match(menu.fldr, v[0]) || f.match(menu.fldr, v[1]) {
+				ls = append(ls, v)
+			}
+		}
+		if len(ls) == 0 {
+			return false
+		}
+		menu.diffList = ls
+		menu.allPairs = all
+	}
+	menu.filter = str
+	menu.itemList = make([]string, len(menu.diffList))
+	menu.Selected = 0
+	for k, v := range menu.diffList {
+		if v == cur {
+			menu.Selected = k
+			break
+		}
+	}
+	if menu.diffList[menu.Selected] != cur {
+		menu.imageLoader()
+	} else {
+		menu.itemList[menu.Selected] = cur[menu.imageSel]
+	}
+	return true
+}
+
 func (menu *DiffMenu) renderer() {
 	if menu.shouldReload {
 		menu.imageLoader()
 		menu.shouldReload = false
 	}
 	menu.ImageMenu.renderer()
+	menu.renderCompareLabels()
+	menu.renderQuality()
 }
 
 func (menu *DiffMenu) imageLoader() int {
@@ -320,12 +501,26 @@ func (menu *DiffMenu) imageLoader() int {
 	menu.pos2 = menu.pos
 	menu.itemList[menu.Selected] = menu.diffList[menu.Selected][menu.imageSel]
 	menu.ImageMenu.imageLoader()
+	menu.clearHeatmap()
+	if menu.compare == COMPARE_DIFF {
+		return menu.loadHeatmap()
+	}
+	return LOOP_CONT
+}
+
+// The pairs are only worked out once, so a DiffMenu doesn't refresh
+func (menu *DiffMenu) refresh() int {
 	return LOOP_CONT
 }
 
 func (menu *DiffMenu) destroy() {
 	menu.ImageMenu.destroy()
 	menu.image2.Destroy()
+	menu.clearHeatmap()
+	err := saveIgnored()
+	if err != nil {
+		panic(err)
+	}
 	if menu.ffmpeg2 != nil {
 		menu.ffmpeg2.Destroy()
 		menu.ffmpeg2 = nil
@@ -337,45 +532,14 @@ func makeDiffAllMenu() (*DiffMenu, bool) {
 	if quit {
 		return nil, true
 	}
-	entries, err := os.ReadDir(".")
-	if err != nil {
-		panic(err)
-	}
-	ls := make([]string, 0, len(entries)<<7)
-	for _, fldr := range entries {
-		if fldr.IsDir() && fldr.Name() != "Trash" && fldr.Name()[0] != '.' && fldr.Name()[0] != '$' {
-			entries, err := os.ReadDir(fldr.Name())
-			if err != nil {
-				panic(err)
-			}
-			for _, v := range entries {
-				if !v.IsDir() {
-					ind := strings.LastIndexByte(v.Name(), '.')
-					if ind == -1 {
-						continue
-					}
-					switch strings.ToLower(v.Name()[ind+1:]) {
-					case "mp4":
-						fallthrough
-					case "webm":
-						fallthrough
-					case "gif":
-						fallthrough
-					case "mov":
-						fallthrough
-					case "bmp":
-						fallthrough
-					case "jpg":
-						fallthrough
-					case "png":
-						fallthrough
-					case "jpeg":
-						// Have to use path here because filepath will confuse getHash
-						ls = append(ls, path.Join(fldr.Name(), v.Name()))
-					}
-				}
-			}
+	images, _ := listImages(".", true)
+	ls := make([]string, 0, len(images))
+	for _, v := range images {
+		// Images directly in the root aren't in any category
+		if strings.IndexByte(v, '/') == -1 || inFolder(v, config.TrashFolder) {
+			continue
 		}
+		ls = append(ls, v)
 	}
 	if len(ls) == 0 {
 		_, quit = displayMessage("No supported images.")
@@ -386,100 +550,63 @@ func makeDiffAllMenu() (*DiffMenu, bool) {
 }
 
 func loadHashes() error {
-	f, err := os.Open("imgSort.cache")
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		hashes = make(map[string]hashEntry, 128)
-		return nil
-	} else if err != nil {
-		return err
-	}
-	defer f.Close()
-	reader := bufio.NewReader(f)
-	sz, _ := reader.ReadByte()
-	if sz&128 != 0 || sz != byte(config.HashSize) {
-		hashes = make(map[string]hashEntry, 128)
-		return nil
-	}
-	size := uint16(sz)
-	size *= size
-	size /= 8
-	temp := make([]byte, 4)
-	_, err = reader.Read(temp)
-	if err != nil {
-		return err
-	}
-	entries := binary.BigEndian.Uint32(temp)
-	hashes = make(map[string]hashEntry, entries)
-	var s string
-	for {
-		s, err = reader.ReadString(0)
-		if err != nil {
-			break
-		}
-		s = s[:len(s)-1]
-		_, err = io.ReadFull(reader, temp)
-		if err != nil {
-			break
-		}
-		lModify := int64(binary.BigEndian.Uint32(temp))
-		temp2 := make([]byte, size)
-		_, err = io.ReadFull(reader, temp2)
-		if err != nil {
-			break
-		}
-		hashes[s] = hashEntry{temp2, lModify}
-	}
-	if err == io.EOF {
-		return nil
-	}
+	var err error
+	hashes, err = cache.Load(library.cachePath, byte(config.HashSize))
 	return err
 }
 
 func saveHashes() error {
-	f, err := os.OpenFile("imgSort.cache", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	hashes.HashSize = byte(config.HashSize)
+	return hashes.Save(library.cachePath)
+}
+
+func getHash(path string) ([]byte, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return err
-	}
-	defer f.Close()
-	writer := bufio.NewWriter(f)
-	writer.WriteByte(byte(config.HashSize))
-	temp := make([]byte, 4)
-	binary.BigEndian.PutUint32(temp, uint32(len(hashes)))
-	_, err = writer.Write(temp)
+		return nil, err
+	}
+	hash, ok := hashes.Get(path)
+	if ok && info.ModTime().Unix() == hash.ModTime && hash.Size != 0 {
+		return hash.Hash, nil
+	}
+	// The fingerprint is much cheaper than decoding, and finds files that were moved outside of ImageSort
+	size, fp, err := cache.Fingerprint(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for k, v := range hashes {
-		if v.hash == nil {
-			continue
-		}
-		_, err = writer.WriteString(k)
-		if err != nil {
-			return err
-		}
-		writer.WriteByte(0)
-		binary.BigEndian.PutUint32(temp, uint32(v.modTime))
-		_, err = writer.Write(temp)
-		if err != nil {
-			return err
-		}
-		_, err = writer.Write(v.hash)
-		if err != nil {
-			return err
-		}
+	if ok && info.ModTime().Unix() == hash.ModTime {
+		hash.Size, hash.Fingerprint = size, fp
+		putHash(path, hash)
+		return hash.Hash, nil
+	}
+	moveLock.Lock()
+	hash, ok = hashes.Relocate(".", path, size, fp, info.ModTime().Unix())
+	moveLock.Unlock()
+	if ok {
+		return hash.Hash, nil
+	}
+	hsh, modTime, err := computeHash(path)
+	if err != nil {
+		return nil, err
 	}
-	writer.Flush()
-	return nil
+	putHash(path, cache.Entry{Hash: hsh, ModTime: modTime, Size: size, Fingerprint: fp})
+	return hsh, nil
 }
 
-func getHash(path string) ([]byte, error) {
-	hash, ok := hashes[path]
-	if ok {
-		info, err := os.Stat(path)
-		if err == nil && info.ModTime().Unix() == hash.modTime {
-			return hash.hash, nil
-		}
+// putHash stores the hash of the image at path, unless the image was moved or changed since it was fingerprinted.
+// The moved image is hashed again when it is next needed.
+func putHash(path string, entry cache.Entry) {
+	moveLock.Lock()
+	defer moveLock.Unlock()
+	size, fp, err := cache.Fingerprint(path)
+	if err != nil || size != entry.Size || fp != entry.Fingerprint {
+		return
 	}
+	hashes.Put(path, entry)
+}
+
+// computeHash hashes a file without looking at the cache, and returns its modification time.
+func computeHash(path string) ([]byte, int64, error) {
 	var err error
 	var img image.Image
 	switch strings.ToLower(path[strings.LastIndexByte(path, '.')+1:]) {
@@ -495,18 +622,41 @@ func getHash(path string) ([]byte, error) {
 		img, err = imagehash.OpenImg(path)
 	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	hsh, err := imagehash.DhashHorizontal(img, int(config.HashSize))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	info, err := os.Stat(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	hashes[path] = hashEntry{hsh, info.ModTime().Unix()}
-	return hsh, nil
+	return hsh, info.ModTime().Unix(), nil
+}
+
+// sameFile reports whether a and b are links to the same file. Deleting one of them wouldn't save any space.
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+func hashDistance(x, y []byte) int {
+	if len(x) != len(y) {
+		return len(x) * 8
+	}
+	var c int
+	for i := 0; i < len(x); i++ {
+		c += bits.OnesCount8(x[i] ^ y[i])
+	}
+	return c
 }
 
 func compareBits(x, y []byte) bool {
@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	EXIF_MAKE          = 0x010F
+	EXIF_MODEL         = 0x0110
+	EXIF_SOFTWARE      = 0x0131
+	EXIF_DATETIME      = 0x0132
+	EXIF_IFD_POINTER   = 0x8769
+	EXIF_DATE_ORIGINAL = 0x9003
+)
+
+var errNoExif = errors.New("no exif data")
+
+// readExif returns the ASCII fields of IFD0 and the Exif IFD of a JPEG.
+// Anything that isn't text is skipped, we don't need it.
+func readExif(p string) (map[uint16]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	temp := make([]byte, 4)
+	_, err = io.ReadFull(reader, temp[:2])
+	if err != nil {
+		return nil, err
+	}
+	if temp[0] != 0xFF || temp[1] != 0xD8 {
+		return nil, errNoExif
+	}
+	for {
+		_, err = io.ReadFull(reader, temp)
+		if err != nil {
+			return nil, err
+		}
+		if temp[0] != 0xFF {
+			return nil, errNoExif
+		}
+		// Start of scan or end of image, metadata can't come after this
+		if temp[1] == 0xDA || temp[1] == 0xD9 {
+			return nil, errNoExif
+		}
+		size := int(binary.BigEndian.Uint16(temp[2:])) - 2
+		if size < 0 {
+			return nil, errNoExif
+		}
+		if temp[1] != 0xE1 {
+			_, err = reader.Discard(size)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 6 && string(data[:6]) == "Exif\x00\x00" {
+			return parseTiff(data[6:])
+		}
+	}
+}
+
+func parseTiff(data []byte) (map[uint16]string, error) {
+	if len(data) < 8 {
+		return nil, errNoExif
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errNoExif
+	}
+	out := make(map[uint16]string, 8)
+	sub := parseIfd(data, order, order.Uint32(data[4:]), out)
+	if sub != 0 {
+		parseIfd(data, order, sub, out)
+	}
+	return out, nil
+}
+
+// parseIfd reads the ASCII entries of one IFD into out.
+// It returns the offset of the Exif sub-IFD if there is one.
+func parseIfd(data []byte, order binary.ByteOrder, offset uint32, out map[uint16]string) uint32 {
+	if uint64(offset)+2 > uint64(len(data)) {
+		return 0
+	}
+	count := int(order.Uint16(data[offset:]))
+	pos := int(offset) + 2
+	var sub uint32
+	for i := 0; i < count && pos+12 <= len(data); i++ {
+		entry := data[pos : pos+12]
+		pos += 12
+		tag := order.Uint16(entry)
+		kind := order.Uint16(entry[2:])
+		n := order.Uint32(entry[4:])
+		if tag == EXIF_IFD_POINTER {
+			sub = order.Uint32(entry[8:])
+			continue
+		}
+		// 2 is ASCII
+		if kind != 2 || n == 0 {
+			continue
+		}
+		var value []byte
+		if n <= 4 {
+			value = entry[8 : 8+n]
+		} else {
+			start := order.Uint32(entry[8:])
+			if uint64(start)+uint64(n) > uint64(len(data)) {
+				continue
+			}
+			value = data[start : start+n]
+		}
+		out[tag] = strings.TrimRight(string(value), "\x00 ")
+	}
+	return sub
+}
+
+// dateTaken returns the capture date of an image, or its modification time if it has none.
+func dateTaken(p string) time.Time {
+	tags, err := readExif(p)
+	if err == nil {
+		s, ok := tags[EXIF_DATE_ORIGINAL]
+		if !ok {
+			s = tags[EXIF_DATETIME]
+		}
+		t, err := time.ParseInLocation("2006:01:02 15:04:05", s, time.Local)
+		if err == nil {
+			return t
+		}
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
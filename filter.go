@@ -0,0 +1,343 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// imageFilter narrows a list of images. Every part of it has to match.
+//
+// Words are matched against the file name as a case-insensitive substring,
+// or as a glob if they contain *, ? or [. A word between slashes is a regex.
+// Structured terms take the form key>value or key<value, meaning at least or at most:
+// w and h for dimensions, size for file size (with K, M or G), and date for the date taken.
+// kind:image, kind:video or kind:gif limit the kind of file, and ext:png limits the extension.
+// make:, model: and software: match EXIF fields as a case-insensitive substring.
+type imageFilter struct {
+	names            []func(string) bool
+	exts             []string
+	exif             map[uint16]string
+	minW, maxW       int32
+	minH, maxH       int32
+	minSize, maxSize int64
+	after, before    time.Time
+	kind             string
+}
+
+var errBadFilter = errors.New("bad filter term")
+
+var exifFilterTerms = map[string]uint16{"make": EXIF_MAKE, "model": EXIF_MODEL, "software": EXIF_SOFTWARE}
+
+func parseFilter(s string) (*imageFilter, error) {
+	f := &imageFilter{maxW: math.MaxInt32, maxH: math.MaxInt32, maxSize: math.MaxInt64}
+	for _, v := range strings.Fields(s) {
+		if len(v) > 2 && v[0] == '/' && v[len(v)-1] == '/' {
+			re, err := regexp.Compile(v[1 : len(v)-1])
+			if err != nil {
+				return nil, err
+			}
+			f.names = append(f.names, re.MatchString)
+			continue
+		}
+		if strings.HasPrefix(v, "kind:") {
+			f.kind = strings.ToLower(v[5:])
+			if f.kind != "image" && f.kind != "video" && f.kind != "gif" {
+				return nil, errBadFilter
+			}
+			continue
+		}
+		if key, value, ok := strings.Cut(v, ":"); ok {
+			key = strings.ToLower(key)
+			if key == "ext" {
+				f.exts = append(f.exts, "."+strings.TrimPrefix(strings.ToLower(value), "."))
+				continue
+			}
+			if tag, ok := exifFilterTerms[key]; ok {
+				if f.exif == nil {
+					f.exif = make(map[uint16]string)
+				}
+				f.exif[tag] = strings.ToLower(value)
+				continue
+			}
+		}
+		ind := strings.IndexAny(v, "<>")
+		if ind == -1 {
+			v = strings.ToLower(v)
+			if strings.ContainsAny(v, "*?[") {
+				if _, err := path.Match(v, ""); err != nil {
+					return nil, err
+				}
+				f.names = append(f.names, func(s string) bool {
+					ok, _ := path.Match(v, strings.ToLower(s))
+					return ok
+				})
+			} else {
+				f.names = append(f.names, func(s string) bool { return strings.Contains(strings.ToLower(s), v) })
+			}
+			continue
+		}
+		key, value, atLeast := strings.ToLower(v[:ind]), v[ind+1:], v[ind] == '>'
+		switch key {
+		case "w", "h":
+			i, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			if key == "w" && atLeast {
+				f.minW = int32(i)
+			} else if key == "w" {
+				f.maxW = int32(i)
+			} else if atLeast {
+				f.minH = int32(i)
+			} else {
+				f.maxH = int32(i)
+			}
+		case "size":
+			i, err := parseSize(value)
+			if err != nil {
+				return nil, err
+			}
+			if atLeast {
+				f.minSize = i
+			} else {
+				f.maxSize = i
+			}
+		case "date":
+			t, err := parseDate(value)
+			if err != nil {
+				return nil, err
+			}
+			if atLeast {
+				f.after = t
+			} else {
+				f.before = t
+			}
+		default:
+			return nil, errBadFilter
+		}
+	}
+	return f, nil
+}
+
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1024
+		case 'm', 'M':
+			mult = 1024 * 1024
+		case 'g', 'G':
+			mult = 1024 * 1024 * 1024
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f * float64(mult)), nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errBadFilter
+}
+
+// cheap is true if the filter only needs the file name.
+func (f *imageFilter) cheap() bool {
+	return f.minW == 0 && f.minH == 0 && f.maxW == math.MaxInt32 && f.maxH == math.MaxInt32 && f.minSize == 0 && f.maxSize == math.MaxInt64 && f.after.IsZero() && f.before.IsZero() && len(f.exif) == 0
+}
+
+func (f *imageFilter) match(fldr, name string) bool {
+	base := path.Base(filepath.ToSlash(name))
+	for _, v := range f.names {
+		if !v(base) {
+			return false
+		}
+	}
+	if len(f.exts) != 0 && !slices.Contains(f.exts, strings.ToLower(path.Ext(base))) {
+		return false
+	}
+	switch f.kind {
+	case "image":
+		if isAnimated(base) {
+			return false
+		}
+	case "video":
+		if !isAnimated(base) || strings.EqualFold(path.Ext(base), ".gif") {
+			return false
+		}
+	case "gif":
+		if !strings.EqualFold(path.Ext(base), ".gif") {
+			return false
+		}
+	}
+	if f.cheap() {
+		return true
+	}
+	p := filepath.Join(fldr, name)
+	if f.minSize != 0 || f.maxSize != math.MaxInt64 {
+		info, err := os.Stat(p)
+		if err != nil || info.Size() < f.minSize || info.Size() > f.maxSize {
+			return false
+		}
+	}
+	if f.minW != 0 || f.minH != 0 || f.maxW != math.MaxInt32 || f.maxH != math.MaxInt32 {
+		w, h, err := imageDimensions(p)
+		if err != nil || w < f.minW || w > f.maxW || h < f.minH || h > f.maxH {
+			return false
+		}
+	}
+	if !f.after.IsZero() || !f.before.IsZero() {
+		t := dateTaken(p)
+		if t.Before(f.after) || (!f.before.IsZero() && t.After(f.before)) {
+			return false
+		}
+	}
+	if len(f.exif) != 0 {
+		tags, err := readExif(p)
+		if err != nil {
+			return false
+		}
+		for k, v := range f.exif {
+			if !strings.Contains(strings.ToLower(tags[k]), v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *imageFilter) apply(fldr string, ls []string) []string {
+	out := make([]string, 0, len(ls))
+	for _, v := range ls {
+		if f.match(fldr, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// FilterMessage is a text input that shows how many items the filter matches as it is typed.
+// If it has a menu, the filter is applied to the menu as it is typed, and the menu is drawn behind it.
+// Filters that need to look inside the files are only applied when submitted, since they are slow.
+type FilterMessage struct {
+	TextInputMessage
+	fldr      string
+	items     []string
+	submitted bool
+	menu      Menu
+	preview   func(string) bool
+}
+
+func (fm *FilterMessage) update() {
+	status := ""
+	f, err := parseFilter(fm.output)
+	if err != nil {
+		status = "(invalid)"
+	} else if f.cheap() {
+		n := len(f.apply(fm.fldr, fm.items))
+		if fm.output != "" {
+			status = fmt.Sprintf("(%d of %d)", n, len(fm.items))
+		}
+		if fm.preview != nil && n != 0 {
+			fm.preview(strings.TrimSpace(fm.output))
+		}
+	}
+	if fm.image != nil {
+		fm.image.Destroy()
+	}
+	fm.redrawText("Filter: " + fm.output + " " + status)
+}
+
+func (fm *FilterMessage) renderer() {
+	if fm.menu == nil {
+		fm.TextInputMessage.renderer()
+		return
+	}
+	display.SetDrawColor(64, 64, 64, 0)
+	fm.menu.renderer()
+	display.Copy(fm.image, nil, fm.pos)
+}
+
+func (fm *FilterMessage) textInput(event *sdl.TextInputEvent) {
+	if event == nil {
+		fm.output = "\x00"
+		return
+	}
+	fm.output += event.GetText()
+	fm.update()
+}
+
+func (fm *FilterMessage) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_BACKSPACE:
+		if len(fm.output) > 0 {
+			fm.output = fm.output[:len(fm.output)-1]
+			fm.update()
+		}
+		return LOOP_CONT
+	case sdl.K_RETURN:
+		fm.submitted = true
+	}
+	return fm.TextInputMessage.keyHandler(key)
+}
+
+// promptFilter asks for a filter for items in fldr, starting with current.
+// If menu and preview are set, preview is called to filter menu as the filter is typed, and returns false if nothing matched.
+// If the prompt is cancelled, current is returned, and passed to preview to put the menu back. If the program should quit, "\x00" is returned.
+func promptFilter(current, fldr string, items []string, menu Menu, preview func(string) bool) string {
+	fm := &FilterMessage{fldr: fldr, items: items, menu: menu, preview: preview}
+	fm.output = current
+	fm.update()
+	sdl.StartTextInput()
+	stdEventLoop(fm)
+	sdl.StopTextInput()
+	fm.image.Destroy()
+	if fm.output == "\x00" {
+		return fm.output
+	}
+	if !fm.submitted {
+		if preview != nil {
+			preview(current)
+		}
+		return current
+	}
+	return strings.TrimSpace(fm.output)
+}
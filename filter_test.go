@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		ok     bool
+		cheap  bool
+	}{
+		{"", true, true},
+		{"cat dog", true, true},
+		{"*.png", true, true},
+		{"/^img[0-9]+/", true, true},
+		{"kind:video ext:.MP4", true, true},
+		{"w>100 h<2000", true, false},
+		{"size>1.5M", true, false},
+		{"date>2020-05", true, false},
+		{"make:canon", true, false},
+		{"/[/", false, false},
+		{"[", false, false},
+		{"kind:photo", false, false},
+		{"depth>3", false, false},
+		{"w>wide", false, false},
+		{"size<lots", false, false},
+		{"date<yesterday", false, false},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.filter)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%q: no error", tt.filter)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%q: %s", tt.filter, err.Error())
+			continue
+		}
+		if f.cheap() != tt.cheap {
+			t.Errorf("%q: cheap is %v, expected %v", tt.filter, f.cheap(), tt.cheap)
+		}
+	}
+}
+
+func TestParseFilterTerms(t *testing.T) {
+	f, err := parseFilter("W>100 h<2000 size>1.5k size<2G date>2020-05 date<2021 EXT:.JPG model:EOS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.minW != 100 || f.maxW != math.MaxInt32 || f.minH != 0 || f.maxH != 2000 {
+		t.Errorf("dimensions %d-%d by %d-%d", f.minW, f.maxW, f.minH, f.maxH)
+	}
+	if f.minSize != 1536 || f.maxSize != 2*1024*1024*1024 {
+		t.Errorf("size %d-%d", f.minSize, f.maxSize)
+	}
+	if !f.after.Equal(time.Date(2020, 5, 1, 0, 0, 0, 0, time.Local)) || !f.before.Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("dates %s to %s", f.after, f.before)
+	}
+	if len(f.exts) != 1 || f.exts[0] != ".jpg" {
+		t.Errorf("extensions %v", f.exts)
+	}
+	if f.exif[EXIF_MODEL] != "eos" {
+		t.Errorf("exif %v", f.exif)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		name   string
+		match  bool
+	}{
+		{"", "a/b.jpg", true},
+		{"CAT", "Cats.jpg", true},
+		{"cat", "dog.jpg", false},
+		// Only the file name is matched, not the folder it's in
+		{"cat", "cats/dog.jpg", false},
+		{"cat dog", "cat.jpg", false},
+		{"cat dog", "catdog.jpg", true},
+		{"*.PNG", "a/shot.png", true},
+		{"*.png", "shot.png.jpg", false},
+		{"img?.jpg", "IMG1.jpg", true},
+		{"/^IMG_[0-9]+\\./", "IMG_0042.jpg", true},
+		{"/^IMG_[0-9]+\\./", "img_0042.jpg", false},
+		{"ext:png", "a.PNG", true},
+		{"ext:png ext:gif", "a.gif", true},
+		{"ext:png", "a.jpg", false},
+		{"kind:image", "a.jpg", true},
+		{"kind:image", "a.gif", false},
+		{"kind:video", "a.webm", true},
+		{"kind:video", "a.gif", false},
+		{"kind:gif", "a.GIF", true},
+		{"kind:gif", "a.mp4", false},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%q: %s", tt.filter, err.Error())
+			continue
+		}
+		if got := f.match("", tt.name); got != tt.match {
+			t.Errorf("%q matching %s is %v, expected %v", tt.filter, tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestFilterMatchSize(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"small.jpg": 100, "big.jpg": 3000} {
+		err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := parseFilter("size>1k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := f.apply(dir, []string{"small.jpg", "big.jpg", "missing.jpg"})
+	if len(got) != 1 || got[0] != "big.jpg" {
+		t.Errorf("got %v, expected [big.jpg]", got)
+	}
+}
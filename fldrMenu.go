@@ -18,23 +18,30 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path"
+	"slices"
 	"strings"
 
+	"github.com/jlortiz0/ImageSort/cache"
 	"github.com/veandco/go-sdl2/sdl"
 )
 
 type FolderMenu struct {
 	*ChoiceMenu
+	// The folder being listed and the paths of the folders in it.
+	// If dir isn't the root, the first entry goes up a level.
+	dir  string
+	dirs []string
+	next string
 }
 
-func beginFldrMenu() {
-	sel := 0
-FolderRegen:
-	fList, err := os.ReadDir(".")
+// listFolders lists the folders in dir as slash-separated paths, leaving out Sort and Trash.
+// If recursive is set, subfolders are listed after their parent.
+func listFolders(dir string, recursive bool) []string {
+	fList, err := os.ReadDir(dir)
 	if err != nil {
 		panic(err)
 	}
@@ -42,28 +49,143 @@ FolderRegen:
 	for _, v := range fList {
 		if v.IsDir() {
 			s := v.Name()
-			if s != "Sort" && s != "Trash" && s != "System Volume Information" && s[0] != '$' && s[0] != '.' {
-				dList = append(dList, s)
+			p := path.Join(dir, s)
+			if p == config.SortFolder || p == config.TrashFolder {
+				continue
 			}
+			if s != "System Volume Information" && s[0] != '$' && s[0] != '.' {
+				dList = append(dList, p)
+			}
+		}
+	}
+	if config.SortMode == SORT_NATURAL {
+		sortNatural(dList)
+	}
+	if !recursive {
+		return dList
+	}
+	out := make([]string, 0, len(dList))
+	for _, v := range dList {
+		out = append(out, v)
+		out = append(out, listFolders(v, true)...)
+	}
+	return out
+}
+
+func hasSubfolders(dir string) bool {
+	fList, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, v := range fList {
+		if v.IsDir() && v.Name()[0] != '.' && v.Name()[0] != '$' {
+			return true
+		}
+	}
+	return false
+}
+
+// sortTargets lists the folders that images in Sort can be moved to.
+func sortTargets() []string {
+	return listFolders(".", config.NestedSort != 0)
+}
+
+func beginFldrMenu() {
+	sel := 0
+	dir := "."
+	var prevDir string
+	// If Sort, Trash, New or Options was selected, how far from the end it was
+	var fromEnd int
+FolderRegen:
+	dList := listFolders(dir, false)
+	if _, err := os.Stat(config.SortFolder); os.IsNotExist(err) {
+		os.MkdirAll(config.SortFolder, 0700)
+	}
+	if _, err := os.Stat(config.TrashFolder); os.IsNotExist(err) {
+		os.MkdirAll(config.TrashFolder, 0700)
+	}
+	names := make([]string, 0, len(dList)+5)
+	dirs := make([]string, 0, len(dList)+1)
+	if dir != "." {
+		names = append(names, "..")
+		dirs = append(dirs, path.Dir(dir))
+	}
+	for _, v := range dList {
+		if v == prevDir {
+			sel = len(dirs)
+		}
+		if hasSubfolders(v) {
+			names = append(names, path.Base(v)+"/")
+		} else {
+			names = append(names, path.Base(v))
 		}
+		dirs = append(dirs, v)
 	}
-	if _, err = os.Stat("Sort"); os.IsNotExist(err) {
-		os.Mkdir("Sort", 0700)
+	names = append(names, config.SortFolder, config.TrashFolder, "New...", "Options")
+	if fromEnd != 0 {
+		sel = len(names) - fromEnd
 	}
-	if _, err = os.Stat("Trash"); os.IsNotExist(err) {
-		os.Mkdir("Trash", 0700)
+	if sel >= len(names) {
+		sel = len(names) - 1
 	}
-	dList = append(dList, "Sort", "Trash", "New...", "Options")
-	menu := FolderMenu{makeMenu(dList, sel)}
-	if stdEventLoop(menu) == LOOP_REDO {
+	menu := &FolderMenu{ChoiceMenu: makeMenu(names, sel), dir: dir, dirs: dirs}
+	watched := watchFolder(dir, false)
+	action := stdEventLoop(menu)
+	unwatchFolders(watched)
+	if action == LOOP_REDO {
 		sel = menu.Selected
+		prevDir = ""
+		fromEnd = 0
+		if menu.next != "" {
+			sel = 0
+			if path.Dir(menu.next) == dir {
+				// Entering a folder, skip over ..
+				sel = 1
+			}
+			prevDir = dir
+			dir = menu.next
+		} else if menu.Selected >= len(menu.dirs) {
+			fromEnd = len(menu.itemList) - menu.Selected
+		} else if !menu.isParent() {
+			// Keep the same folder selected if others were added or removed
+			prevDir = menu.dirs[menu.Selected]
+		}
 		menu.destroy()
 		goto FolderRegen
 	}
 	menu.destroy()
 }
 
-func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
+// refresh lists the folders again if any were added or removed by something else.
+func (menu *FolderMenu) refresh() int {
+	changes := takeChanges(menu.dir, false)
+	for k := range changes {
+		if info, err := os.Stat(k); (err == nil && info.IsDir()) || slices.Contains(menu.dirs, k) {
+			return LOOP_REDO
+		}
+	}
+	return LOOP_CONT
+}
+
+func (menu *FolderMenu) renderer() {
+	menu.ChoiceMenu.renderer()
+	drawIndexerStatus()
+}
+
+// isParent is true if the selected entry goes up a level.
+func (menu *FolderMenu) isParent() bool {
+	return menu.dir != "." && menu.Selected == 0
+}
+
+// target is the path of the selected folder, including Sort and Trash.
+func (menu *FolderMenu) target() string {
+	if menu.Selected < len(menu.dirs) {
+		return menu.dirs[menu.Selected]
+	}
+	return menu.itemList[menu.Selected]
+}
+
+func (menu *FolderMenu) keyHandler(key sdl.Keycode) int {
 	switch key {
 	case sdl.K_RETURN:
 		ld := len(menu.itemList)
@@ -80,6 +202,7 @@ func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
 			if fldrName == "\x00" {
 				return LOOP_QUIT
 			} else if fldrName != "" {
+				fldrName = path.Join(menu.dir, fldrName)
 				if _, err := os.Stat(fldrName); os.IsNotExist(err) {
 					os.Mkdir(fldrName, 0700)
 					return LOOP_REDO
@@ -106,7 +229,7 @@ func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
 			fadeScreen()
 		case ld - 4:
 			// Sort
-			imgMenu, quit := makeSortMenu(menu.itemList[:len(menu.itemList)-4])
+			imgMenu, quit := makeSortMenu(sortTargets())
 			if quit {
 				return LOOP_QUIT
 			}
@@ -121,8 +244,12 @@ func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
 			menu.renderer()
 			fadeScreen()
 		default:
-			// Other folder
-			imgMenu, quit := makeImageMenu(menu.itemList[menu.Selected])
+			if menu.isParent() {
+				menu.next = menu.dirs[0]
+				return LOOP_REDO
+			}
+			// Other folder, with subfolders if shift is held
+			imgMenu, quit := makeImageMenu(menu.dirs[menu.Selected], sdl.GetModState()&sdl.KMOD_SHIFT != 0)
 			if quit {
 				return LOOP_QUIT
 			}
@@ -137,9 +264,19 @@ func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
 			menu.renderer()
 			fadeScreen()
 		}
+	case sdl.K_RIGHT:
+		if menu.Selected < len(menu.dirs) && !menu.isParent() && hasSubfolders(menu.dirs[menu.Selected]) {
+			menu.next = menu.dirs[menu.Selected]
+			return LOOP_REDO
+		}
+	case sdl.K_LEFT, sdl.K_BACKSPACE:
+		if menu.dir != "." {
+			menu.next = path.Dir(menu.dir)
+			return LOOP_REDO
+		}
 	case sdl.K_d:
-		if menu.Selected < len(menu.itemList)-4 {
-			dName := menu.itemList[menu.Selected]
+		if menu.Selected < len(menu.dirs) && !menu.isParent() {
+			dName := menu.dirs[menu.Selected]
 			f, err := os.Open(dName)
 			if err != nil {
 				panic(err)
@@ -161,11 +298,19 @@ func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
 			fadeScreen()
 		}
 	case sdl.K_r:
-		if menu.Selected < len(menu.itemList)-2 {
-			imgMenu, quit := makeDiffMenu(menu.itemList[menu.Selected])
+		if menu.Selected < len(menu.itemList)-2 && !menu.isParent() {
+			imgMenu, quit := makeDiffMenu(menu.target())
 			if quit {
 				return LOOP_QUIT
 			}
+			if imgMenu != nil && sdl.GetModState()&sdl.KMOD_SHIFT != 0 {
+				ok, quit := imgMenu.filterCandidates()
+				if quit {
+					return LOOP_QUIT
+				} else if !ok {
+					imgMenu = nil
+				}
+			}
 			if imgMenu != nil {
 				result := imgMenu.initDiff()
 				if result == LOOP_EXIT {
@@ -189,6 +334,14 @@ func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
 		if quit {
 			return LOOP_QUIT
 		}
+		if imgMenu != nil && sdl.GetModState()&sdl.KMOD_SHIFT != 0 {
+			ok, quit := imgMenu.filterCandidates()
+			if quit {
+				return LOOP_QUIT
+			} else if !ok {
+				imgMenu = nil
+			}
+		}
 		if imgMenu != nil {
 			result := imgMenu.initDiff()
 			if result == LOOP_EXIT {
@@ -206,6 +359,43 @@ func (menu FolderMenu) keyHandler(key sdl.Keycode) int {
 		saveScreen()
 		menu.renderer()
 		fadeScreen()
+	case sdl.K_c:
+		if menu.Selected < len(menu.itemList)-2 && !menu.isParent() && menu.target() != config.TrashFolder {
+			if cullFolder(menu.target()) == LOOP_QUIT {
+				return LOOP_QUIT
+			}
+			saveScreen()
+			menu.renderer()
+			fadeScreen()
+		}
+	case sdl.K_k:
+		if checkFolder() == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		saveScreen()
+		menu.renderer()
+		fadeScreen()
+	case sdl.K_n:
+		if reviewIgnored() == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		saveScreen()
+		menu.renderer()
+		fadeScreen()
+	case sdl.K_t:
+		if browseTags() == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		saveScreen()
+		menu.renderer()
+		fadeScreen()
+	case sdl.K_i:
+		if doImport() == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		saveScreen()
+		menu.renderer()
+		fadeScreen()
 	case sdl.K_F5:
 		return LOOP_REDO
 	default:
@@ -220,19 +410,23 @@ type TextInputMessage struct {
 }
 
 func (tim *TextInputMessage) redraw() {
+	tim.redrawText(tim.output)
+}
+
+func (tim *TextInputMessage) redrawText(text string) {
 	pxFmt, _ := window.GetPixelFormat()
 	wW, wH := window.GetSize()
 	var w int
-	if tim.output != "" {
-		w, _, _ = font.SizeUTF8(tim.output)
+	if text != "" {
+		w, _, _ = font.SizeUTF8(text)
 	}
 	surf, err := sdl.CreateRGBSurfaceWithFormat(0, int32(w)+20, fHeight, 24, pxFmt)
 	if err != nil {
 		panic(err)
 	}
 	surf.FillRect(nil, 0xFFFFFF)
-	if tim.output != "" {
-		drawText(tim.output, surf, 10, 5)
+	if text != "" {
+		drawText(text, surf, 10, 5)
 	}
 	tim.image, _ = display.CreateTextureFromSurface(surf)
 	tim.pos = &sdl.Rect{X: (wW - surf.W) / 2, Y: (wH - surf.H) / 2, H: surf.H, W: surf.W}
@@ -338,44 +532,32 @@ type OptionsMenu struct {
 	ChoiceMenu
 }
 
-var optionsMenuOrder = [6]*uint16{&config.FadeSpeed, &config.HashDiff, &config.HashSize, &config.AnimFrame, &config.SizeSort, &config.ReverseSort}
-var optionsMenuMinMaxDelta = [3][6]uint16{{16, 0, 4, 0, 0, 0}, {80, 0xffff, 32, 30, 1, 1}, {4, 1, 4, 1, 1, 1}}
+var optionsMenuOrder = [15]*uint16{&config.FadeSpeed, &config.HashDiff, &config.HashSize, &config.AnimFrame, &config.SortMode, &config.ReverseSort, &config.IgnoreCase, &config.NestedSort, &config.BarOrder, &config.FolderBarAll, &config.BackgroundHash, &config.SuggestFolders, &config.ImportMove, &config.Xmp, &config.KeepPolicy}
+var optionsMenuMinMaxDelta = [3][15]uint16{{16, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, {80, 0xffff, 32, 30, uint16(len(sortModeNames) - 1), 1, 1, 1, uint16(len(barOrderNames) - 1), 1, 1, 1, 1, uint16(len(xmpModeNames) - 1), uint16(len(keepPolicyNames) - 1)}, {4, 1, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}}
+
+// Options that are shown as a name instead of a number
+var optionsMenuNames = map[*uint16][]string{&config.SortMode: sortModeNames, &config.BarOrder: barOrderNames, &config.Xmp: xmpModeNames, &config.KeepPolicy: keepPolicyNames}
 
 func doOptionsMenu() int {
 	men := new(OptionsMenu)
-	men.itemList = []string{"Fade Speed: %d", "Dupe Sensitivity: %d", "Sample Size: %d", "Dedup Frame: %d", "Sort by Size: %t", "Reverse Sort: %t"}
+	men.itemList = []string{"Fade Speed: %d", "Dupe Sensitivity: %d", "Sample Size: %d", "Dedup Frame: %d", "Sort By: %s", "Reverse Sort: %t", "Ignore Case: %t", "Nested Sort Folders: %t", "Bar Order: %s", "Folder Bar Everywhere: %t", "Background Hashing: %t", "Suggest Folders: %t", "Import Moves Files: %t", "XMP: %s", "Keep Best By: %s"}
+	// The indexer can't run while the hash settings change under it
+	stopIndexer()
 	configCopy := config
 	action := stdEventLoop(men)
 	men.destroy()
 	if action == LOOP_QUIT {
 		return action
 	}
-	b, err := json.Marshal(&config)
-	if err != nil {
-		panic(err)
-	}
-	err = os.WriteFile("ImgSort.cfg", b, 0644)
+	defer startIndexer()
+	err := saveConfig()
 	if err != nil {
 		panic(err)
 	}
 	if configCopy.HashSize != config.HashSize {
-		for k := range hashes {
-			delete(hashes, k)
-		}
+		hashes.Clear(byte(config.HashSize))
 	} else if configCopy.AnimFrame != config.AnimFrame {
-		for k := range hashes {
-			switch strings.ToLower(k[strings.LastIndexByte(k, '.')+1:]) {
-			case "mp4":
-				fallthrough
-			case "webm":
-				fallthrough
-			case "gif":
-				fallthrough
-			case "mov":
-				delete(hashes, k)
-			default:
-			}
-		}
+		hashes.DeleteIf(func(k string, _ cache.Entry) bool { return isAnimated(k) })
 	}
 	return action
 }
@@ -390,6 +572,8 @@ func (men *OptionsMenu) renderer() {
 				b = true
 			}
 			menuList[k] = fmt.Sprintf(men.itemList[k], b)
+		} else if names, ok := optionsMenuNames[optionsMenuOrder[k]]; ok {
+			menuList[k] = fmt.Sprintf(men.itemList[k], names[*optionsMenuOrder[k]])
 		} else {
 			menuList[k] = fmt.Sprintf(men.itemList[k], *optionsMenuOrder[k])
 		}
@@ -0,0 +1,466 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// The keys used for the folder bar if FolderKeys isn't set
+const DEFAULT_FOLDER_KEYS = "1234567890-="
+
+// Keys the image browser, Sort, Trash and the deduplicator need for themselves, which can't be used for folders.
+// WASD is matched by where the key is rather than what it types, so it is reserved too.
+const RESERVED_FOLDER_KEYS = "abcdfghiklmnopqrstuvwxz/[]"
+
+const (
+	BAR_ORDER_NAME = iota
+	BAR_ORDER_RECENT
+)
+
+var barOrderNames = []string{"Name", "Recently Used"}
+
+// Only this many folders are remembered for Recently Used
+const maxRecentFolders = 50
+
+// Only this many matches are shown when searching for a folder
+const maxFolderMatches = 8
+
+// folderKeys returns the keys for each slot of a page of the folder bar.
+// Keys that are repeated, reserved or not printable are skipped.
+func folderKeys() []byte {
+	keys := make([]byte, 0, len(config.FolderKeys))
+	for _, c := range []byte(strings.ToLower(config.FolderKeys)) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(RESERVED_FOLDER_KEYS, c) != -1 || slices.Contains(keys, c) {
+			continue
+		}
+		keys = append(keys, c)
+	}
+	if len(keys) == 0 {
+		return []byte(DEFAULT_FOLDER_KEYS)
+	}
+	return keys
+}
+
+// orderFolderBar puts pinned folders first, then recently used ones if Bar Order is set to that.
+// The rest keep their order.
+func orderFolderBar(folders []string) []string {
+	out := make([]string, 0, len(folders))
+	seen := make(map[string]bool, len(folders))
+	add := func(ls []string) {
+		for _, v := range ls {
+			if !seen[v] && slices.Contains(folders, v) {
+				seen[v] = true
+				out = append(out, v)
+			}
+		}
+	}
+	add(config.PinnedFolders)
+	if config.BarOrder == BAR_ORDER_RECENT {
+		add(config.RecentFolders)
+	}
+	add(folders)
+	return out
+}
+
+// noteFolderUsed moves folder to the front of the recently used list.
+// The folder bar isn't reordered until the next time Sort is opened, so keys don't move around while sorting.
+func noteFolderUsed(folder string) {
+	ls := slices.DeleteFunc(config.RecentFolders, func(s string) bool { return s == folder })
+	ls = slices.Insert(ls, 0, folder)
+	if len(ls) > maxRecentFolders {
+		ls = ls[:maxRecentFolders]
+	}
+	config.RecentFolders = ls
+}
+
+// togglePinned pins a folder to the start of the folder bar, or unpins it if it already is.
+func togglePinned(folder string) {
+	if i := slices.Index(config.PinnedFolders, folder); i != -1 {
+		config.PinnedFolders = slices.Delete(config.PinnedFolders, i, i+1)
+	} else {
+		config.PinnedFolders = append(config.PinnedFolders, folder)
+	}
+	err := saveConfig()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// matchFolders finds the folders containing every word of query, in any case.
+// Folders whose name starts with the query come first, then ones whose name contains it, then ones where only the path does.
+// Otherwise, folders keep their order.
+func matchFolders(query string, folders []string) []string {
+	words := strings.Fields(strings.ToLower(query))
+	rank := func(v string) int {
+		lower := strings.ToLower(v)
+		for _, w := range words {
+			if !strings.Contains(lower, w) {
+				return -1
+			}
+		}
+		base := path.Base(lower)
+		if len(words) != 0 && strings.HasPrefix(base, words[0]) {
+			return 0
+		} else if len(words) != 0 && strings.Contains(base, words[0]) {
+			return 1
+		}
+		return 2
+	}
+	var buckets [3][]string
+	for _, v := range folders {
+		if r := rank(v); r != -1 {
+			buckets[r] = append(buckets[r], v)
+		}
+	}
+	return append(append(buckets[0], buckets[1]...), buckets[2]...)
+}
+
+// FolderSearch picks a folder by typing part of its name.
+// When tagging, it picks a tag instead, and a tag that doesn't exist yet can be typed in full.
+type FolderSearch struct {
+	TextInputMessage
+	folders []string
+	matches []string
+	sel     int
+	chosen  string
+	tagging bool
+}
+
+func (fs *FolderSearch) update() {
+	fs.matches = matchFolders(fs.output, fs.folders)
+	if fs.sel >= len(fs.matches) {
+		fs.sel = max(len(fs.matches)-1, 0)
+	}
+	lines := []string{"Move to: " + fs.output}
+	if fs.tagging {
+		lines[0] = "Tag: " + fs.output
+	}
+	if len(fs.matches) == 0 && fs.tagging && cleanTag(fs.output) != "" {
+		lines = append(lines, "(new tag)")
+	} else if len(fs.matches) == 0 {
+		lines = append(lines, "(no matches)")
+	}
+	// Keep the selection on screen
+	start := max(fs.sel-maxFolderMatches+1, 0)
+	for k, v := range fs.matches[start:min(start+maxFolderMatches, len(fs.matches))] {
+		prefix := "  "
+		if k+start == fs.sel {
+			prefix = "> "
+		}
+		if !fs.tagging && slices.Contains(config.PinnedFolders, v) {
+			v += " (pinned)"
+		}
+		lines = append(lines, prefix+v)
+	}
+	if len(fs.matches) > maxFolderMatches {
+		lines = append(lines, "...")
+	}
+	if fs.tagging {
+		lines = append(lines, "Enter - Add/remove tag")
+	} else {
+		lines = append(lines, "Enter - Move  Tab - Pin/unpin")
+	}
+	if fs.image != nil {
+		fs.image.Destroy()
+	}
+	fs.image, fs.pos = drawMessage(strings.Join(lines, "\n"))
+}
+
+func (fs *FolderSearch) textInput(event *sdl.TextInputEvent) {
+	if event == nil {
+		fs.output = "\x00"
+		return
+	}
+	fs.output += event.GetText()
+	fs.sel = 0
+	fs.update()
+}
+
+func (fs *FolderSearch) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_BACKSPACE:
+		if len(fs.output) > 0 {
+			fs.output = fs.output[:len(fs.output)-1]
+			fs.sel = 0
+			fs.update()
+		}
+	case sdl.K_UP:
+		if fs.sel > 0 {
+			fs.sel--
+			fs.update()
+		}
+	case sdl.K_DOWN:
+		if fs.sel < len(fs.matches)-1 {
+			fs.sel++
+			fs.update()
+		}
+	case sdl.K_TAB:
+		if fs.sel < len(fs.matches) && !fs.tagging {
+			togglePinned(fs.matches[fs.sel])
+			fs.update()
+		}
+	case sdl.K_RETURN:
+		if fs.sel < len(fs.matches) {
+			fs.chosen = fs.matches[fs.sel]
+		} else if fs.tagging {
+			fs.chosen = cleanTag(fs.output)
+		}
+		return LOOP_EXIT
+	case sdl.K_ESCAPE:
+		return LOOP_EXIT
+	}
+	return LOOP_CONT
+}
+
+// searchFolders asks for one of folders by name, or for a tag if tagging is set. It returns an empty string if nothing was picked, or "\x00" if the program should quit.
+func searchFolders(folders []string, tagging bool) string {
+	fs := &FolderSearch{folders: folders, tagging: tagging}
+	fs.update()
+	sdl.StartTextInput()
+	stdEventLoop(fs)
+	sdl.StopTextInput()
+	fs.image.Destroy()
+	if fs.output == "\x00" {
+		return fs.output
+	}
+	return fs.chosen
+}
+
+// FolderBar is the row of folders along the top of an image browser. Each folder on the current page has a key that moves the image there.
+type FolderBar struct {
+	folders []string
+	keys    []byte
+	texture *sdl.Texture
+	// Where each page starts in folders, and the page being shown
+	pos  []int
+	ind  int
+	show bool
+	// Folders to highlight, such as suggestions
+	marked []string
+	// Whether this is a bar of tags instead of folders
+	tags bool
+	// Whether the recently used folders have changed and need to be saved
+	used bool
+}
+
+// barTargets lists the folders an image in fldr can be moved to with the folder bar.
+func barTargets(fldr string) []string {
+	return slices.DeleteFunc(sortTargets(), func(s string) bool { return s == fldr })
+}
+
+func makeFolderBar(folders []string) *FolderBar {
+	bar := &FolderBar{folders: orderFolderBar(folders), keys: folderKeys(), show: len(folders) > 0}
+	bar.layout()
+	return bar
+}
+
+// barHeight is how much of the top of the window the folder bar covers.
+func barHeight() int32 {
+	return int32(font.Height()) * 6 / 5
+}
+
+// layout splits the folders into pages, each as wide as the window and with at most one folder per key.
+func (bar *FolderBar) layout() {
+	bar.pos = []int{0}
+	spaces, _, _ := font.SizeUTF8(" ")
+	spaces /= 2
+	totalLen := int32(spaces)
+	curPos := 0
+	for k, v := range bar.folders {
+		fW, _, _ := font.SizeUTF8(fmt.Sprintf(" %c %s ", bar.keys[curPos%len(bar.keys)], v))
+		if curPos == len(bar.keys) || (curPos > 0 && int32(fW)+totalLen > display.GetViewport().W) {
+			bar.pos = append(bar.pos, k)
+			totalLen = int32(spaces)
+			curPos = 0
+		}
+		curPos++
+		totalLen += int32(fW)
+	}
+	if curPos > 0 {
+		bar.pos = append(bar.pos, len(bar.folders))
+	}
+	if bar.ind >= len(bar.pos)-1 {
+		bar.ind = 0
+	}
+}
+
+// page is the folders on the page being shown.
+func (bar *FolderBar) page() []string {
+	return bar.folders[bar.pos[bar.ind]:bar.pos[bar.ind+1]]
+}
+
+// load draws the current page. The folder at index highlight of the page is highlighted, or the marked folders if it is -1.
+func (bar *FolderBar) load(highlight int) {
+	if len(bar.folders) == 0 {
+		return
+	}
+	var totalLen int32
+	pxFmt, _ := window.GetPixelFormat()
+	barSurf, err := sdl.CreateRGBSurfaceWithFormat(0, display.GetViewport().W, barHeight(), 32, pxFmt)
+	if err != nil {
+		panic(err)
+	}
+	barSurf.FillRect(nil, 0xFFFFFF)
+	for k, v := range bar.page() {
+		suggested := slices.Contains(bar.marked, v)
+		v = fmt.Sprintf(" %c %s ", bar.keys[k], v)
+		fW, _, _ := font.SizeUTF8(v)
+		if highlight == k || (highlight == -1 && suggested) {
+			bg := COLOR_BLUE
+			if highlight != k {
+				bg = COLOR_SUGGEST
+			}
+			txtSurf, err := font.RenderUTF8Shaded(v, COLOR_BLACK, bg)
+			if err != nil {
+				panic(err)
+			}
+			txtSurf.Blit(nil, barSurf, &sdl.Rect{X: totalLen, Y: int32(font.Height()) / 10})
+			txtSurf.Free()
+		} else {
+			drawText(v, barSurf, totalLen, 0)
+		}
+		totalLen += int32(fW)
+	}
+	barSurf2, err := sdl.CreateRGBSurfaceWithFormat(0, display.GetViewport().W, barHeight(), 32, pxFmt)
+	if err != nil {
+		panic(err)
+	}
+	barSurf2.FillRect(nil, 0xFFFFFF)
+	spaces, _, _ := font.SizeUTF8(" ")
+	barSurf.Blit(nil, barSurf2, &sdl.Rect{H: barHeight(), W: display.GetViewport().W, X: (display.GetViewport().W - totalLen - int32(spaces)) / 2})
+	barSurf.Free()
+	if bar.texture != nil {
+		bar.texture.Destroy()
+	}
+	bar.texture, err = display.CreateTextureFromSurface(barSurf2)
+	if err != nil {
+		panic(err)
+	}
+	barSurf2.Free()
+}
+
+func (bar *FolderBar) renderer() {
+	if !bar.show || len(bar.folders) == 0 {
+		return
+	}
+	if bar.texture == nil {
+		bar.load(-1)
+	}
+	display.Copy(bar.texture, nil, &sdl.Rect{H: barHeight(), W: display.GetViewport().W})
+}
+
+// keyHandler handles the folder bar's keys: the folder keys, Q or Tab to change page, I to hide it, and / to search.
+// If the key was one of them, ok is true. If the image should be moved, target is the folder to move it to.
+func (bar *FolderBar) keyHandler(key sdl.Keycode) (target string, ret int, ok bool) {
+	if len(bar.folders) == 0 {
+		return "", LOOP_CONT, false
+	}
+	mods := sdl.GetModState()
+	// Ctrl and alt copy or link instead of moving, and folder keys with shift held are left for other things
+	if pos := slices.Index(bar.keys, byte(key)); int(key) < 0x80 && pos != -1 && mods&sdl.KMOD_SHIFT == 0 {
+		if !bar.show || pos >= len(bar.page()) {
+			return "", LOOP_CONT, true
+		}
+		return bar.page()[pos], LOOP_CONT, true
+	}
+	switch key {
+	case sdl.K_q, sdl.K_TAB:
+		if !bar.show {
+			bar.show = true
+		} else if mods&sdl.KMOD_SHIFT != 0 {
+			bar.ind--
+			if bar.ind < 0 {
+				bar.ind = len(bar.pos) - 2
+			}
+		} else {
+			bar.ind++
+			if bar.ind >= len(bar.pos)-1 {
+				bar.ind = 0
+			}
+		}
+		bar.load(-1)
+	case sdl.K_i:
+		bar.show = !bar.show
+	case sdl.K_SLASH:
+		pinned := slices.Clone(config.PinnedFolders)
+		target = searchFolders(bar.folders, bar.tags)
+		if target == "\x00" {
+			return "", LOOP_QUIT, true
+		}
+		if !slices.Equal(pinned, config.PinnedFolders) {
+			bar.folders = orderFolderBar(bar.folders)
+			bar.layout()
+			bar.load(-1)
+		}
+		return target, LOOP_CONT, true
+	default:
+		return "", LOOP_CONT, false
+	}
+	return "", LOOP_CONT, true
+}
+
+// moveTo moves the image at from into target, highlighting target if it is on the current page.
+// If Ctrl or Alt is held, the image is copied or linked into target instead, and stays where it is.
+func (bar *FolderBar) moveTo(menu ImageBrowser, from, target string) int {
+	if path.Dir(filepath.ToSlash(from)) == target {
+		return LOOP_CONT
+	}
+	how := fileAction()
+	if ind := slices.Index(bar.page(), target); ind != -1 {
+		bar.load(ind)
+	}
+	noteFolderUsed(target)
+	bar.used = true
+	if how == FILE_MOVE {
+		ret := moveFile(menu, from, target)
+		bar.load(-1)
+		return ret
+	}
+	menu.renderer()
+	display.Present()
+	_, err := fileImage(from, target, how)
+	bar.load(-1)
+	if err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), []string{"Could not file image:"}))
+		if quit {
+			return LOOP_QUIT
+		}
+		return LOOP_CONT
+	}
+	menu.setNotice(fileActionNames[how] + " to " + target)
+	return LOOP_CONT
+}
+
+func (bar *FolderBar) destroy() {
+	if bar.texture != nil {
+		bar.texture.Destroy()
+	}
+	if bar.used {
+		err := saveConfig()
+		if err != nil {
+			panic(err)
+		}
+	}
+}
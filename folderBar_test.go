@@ -0,0 +1,75 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFolderKeys(t *testing.T) {
+	old := config.FolderKeys
+	defer func() { config.FolderKeys = old }()
+	tests := []struct {
+		keys string
+		out  string
+	}{
+		{"", DEFAULT_FOLDER_KEYS},
+		{"123", "123"},
+		{"1123221", "123"},
+		// Reserved keys are skipped, in either case
+		{"1a2S3/4[5]", "12345"},
+		{"EJY", "ejy"},
+		{"1 2\t3\x7f", "123"},
+		{"asdf", DEFAULT_FOLDER_KEYS},
+		{"1234;',.", "1234;',."},
+	}
+	for _, tt := range tests {
+		config.FolderKeys = tt.keys
+		if got := string(folderKeys()); got != tt.out {
+			t.Errorf("%q: got %q, expected %q", tt.keys, got, tt.out)
+		}
+	}
+}
+
+func TestMatchFolders(t *testing.T) {
+	folders := []string{"animals/cats", "animals/dogs", "bobcat", "cat pictures", "scatter", "wallpapers", "catalog/dogs"}
+	tests := []struct {
+		query string
+		out   []string
+	}{
+		{"", folders},
+		{"zebra", nil},
+		// Start of the name, then inside the name, then anywhere in the path
+		{"cat", []string{"animals/cats", "cat pictures", "bobcat", "scatter", "catalog/dogs"}},
+		{"CAT", []string{"animals/cats", "cat pictures", "bobcat", "scatter", "catalog/dogs"}},
+		{"dogs", []string{"animals/dogs", "catalog/dogs"}},
+		{"animals", []string{"animals/cats", "animals/dogs"}},
+		{"dog anim", []string{"animals/dogs"}},
+		{"pic cat", []string{"cat pictures"}},
+	}
+	for _, tt := range tests {
+		got := matchFolders(tt.query, folders)
+		if len(got) == 0 && len(tt.out) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.out) {
+			t.Errorf("%q: got %v, expected %v", tt.query, got, tt.out)
+		}
+	}
+}
@@ -7,11 +7,12 @@ require (
 	github.com/adrg/sysfont v0.1.2
 	github.com/devedge/imagehash v0.0.0-20180324030135-7061aa3b4066
 	github.com/disintegration/imaging v1.6.2 // indirect
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/jlortiz0/multisav/streamy v1.2.1
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/veandco/go-sdl2 v0.4.25
 	golang.org/x/image v0.21.0 // indirect
-	golang.org/x/sys v0.1.0
+	golang.org/x/sys v0.4.0
 )
 
 require (
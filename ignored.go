@@ -0,0 +1,259 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jlortiz0/ImageSort/cache"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// IgnoredPair is a pair of images that were decided not to be duplicates. The names are only for showing, and may be out of date.
+type IgnoredPair struct {
+	A, B string
+}
+
+// IgnoreList keeps the pairs the deduplicator shouldn't show again.
+// Pairs are keyed by the fingerprints of both files, so they stay ignored when the files are moved or renamed.
+type IgnoreList struct {
+	pairs map[string]IgnoredPair
+	dirty bool
+}
+
+var ignored = &IgnoreList{pairs: make(map[string]IgnoredPair)}
+
+func loadIgnored() error {
+	ignored = &IgnoreList{pairs: make(map[string]IgnoredPair)}
+	data, err := os.ReadFile(library.ignoredPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &ignored.pairs)
+}
+
+// saveIgnored writes the ignored pairs if they have changed since they were loaded.
+func saveIgnored() error {
+	if !ignored.dirty {
+		return nil
+	}
+	b, err := json.Marshal(ignored.pairs)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(library.ignoredPath, b, 0644)
+	if err == nil {
+		ignored.dirty = false
+	}
+	return err
+}
+
+// fingerprintKey identifies the contents of the image at p, or returns an empty string if it can't be read.
+// The hash cache's fingerprint is used if it is up to date.
+func fingerprintKey(p string) string {
+	info, err := os.Stat(p)
+	if err != nil {
+		return ""
+	}
+	size, fp := info.Size(), uint64(0)
+	if hash, ok := hashes.Get(filepath.ToSlash(p)); ok && hash.ModTime == info.ModTime().Unix() && hash.Size == size {
+		fp = hash.Fingerprint
+	}
+	if fp == 0 {
+		size, fp, err = cache.Fingerprint(p)
+		if err != nil || fp == 0 {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%d-%016x", size, fp)
+}
+
+// Rekey moves the ignored pairs of a file whose fingerprint changed from old to new, because only its metadata was changed.
+func (il *IgnoreList) Rekey(old, new string) {
+	if old == "" || new == "" || old == new {
+		return
+	}
+	for k, v := range il.pairs {
+		a, b, _ := strings.Cut(k, "/")
+		if a == old {
+			a = new
+		} else if b == old {
+			b = new
+		} else {
+			continue
+		}
+		delete(il.pairs, k)
+		il.pairs[pairKey(a, b)] = v
+		il.dirty = true
+	}
+}
+
+// pairKey is the key of a pair of fingerprints, the same whichever order they are in.
+func pairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "/" + b
+}
+
+// Has is true if the pair with fingerprint keys a and b is ignored.
+func (il *IgnoreList) Has(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	_, ok := il.pairs[pairKey(a, b)]
+	return ok
+}
+
+// Add ignores the pair of images at a and b. It returns false if either of them can't be read.
+func (il *IgnoreList) Add(a, b string) bool {
+	fa, fb := fingerprintKey(a), fingerprintKey(b)
+	if fa == "" || fb == "" {
+		return false
+	}
+	il.pairs[pairKey(fa, fb)] = IgnoredPair{filepath.ToSlash(a), filepath.ToSlash(b)}
+	il.dirty = true
+	return true
+}
+
+// Remove stops ignoring the pair with key k.
+func (il *IgnoreList) Remove(k string) {
+	if _, ok := il.pairs[k]; ok {
+		delete(il.pairs, k)
+		il.dirty = true
+	}
+}
+
+// Clear stops ignoring every pair.
+func (il *IgnoreList) Clear() {
+	if len(il.pairs) != 0 {
+		il.pairs = make(map[string]IgnoredPair)
+		il.dirty = true
+	}
+}
+
+// Keys lists the keys of the ignored pairs, sorted by the names of their images.
+func (il *IgnoreList) Keys() []string {
+	out := make([]string, 0, len(il.pairs))
+	for k := range il.pairs {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := il.pairs[out[i]], il.pairs[out[j]]
+		if a.A != b.A {
+			return a.A < b.A
+		}
+		return a.B < b.B
+	})
+	return out
+}
+
+// ignorePair stops the current pair from being shown again, in this run and later ones.
+func (menu *DiffMenu) ignorePair() int {
+	pair := menu.diffList[menu.Selected]
+	if !ignored.Add(filepath.Join(menu.fldr, pair[0]), filepath.Join(menu.fldr, pair[1])) {
+		menu.setNotice("Could not read the images to ignore them")
+		return LOOP_CONT
+	}
+	if menu.allPairs != nil {
+		menu.allPairs = slices.DeleteFunc(menu.allPairs, func(v [2]string) bool { return v == pair })
+	}
+	menu.diffList = slices.Delete(menu.diffList, menu.Selected, menu.Selected+1)
+	menu.itemList = menu.itemList[:len(menu.itemList)-1]
+	if menu.Selected >= len(menu.diffList) || (menu.prevMoveDir && menu.Selected > 0) {
+		menu.Selected--
+	}
+	menu.stopAnim()
+	menu.setNotice("Pair ignored")
+	return menu.imageLoader()
+}
+
+// IgnoredMenu lists the ignored pairs so they can be shown by the deduplicator again. The last entry clears them all.
+type IgnoredMenu struct {
+	*ChoiceMenu
+	keys []string
+}
+
+func (menu *IgnoredMenu) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_d:
+		// Show this pair again
+		if menu.Selected < len(menu.keys) {
+			ignored.Remove(menu.keys[menu.Selected])
+			return LOOP_REDO
+		}
+	case sdl.K_RETURN:
+		if menu.Selected == len(menu.keys) {
+			yes, quit := displayMessage(fmt.Sprintf("Show all %d ignored pairs\nin the deduplicator again?\nZ - Yes  X - No", len(menu.keys)))
+			if quit {
+				return LOOP_QUIT
+			} else if yes {
+				ignored.Clear()
+				return LOOP_EXIT
+			}
+			saveScreen()
+			menu.renderer()
+			fadeScreen()
+		}
+	default:
+		return menu.ChoiceMenu.keyHandler(key)
+	}
+	return LOOP_CONT
+}
+
+// reviewIgnored lists the ignored pairs, with D to stop ignoring one.
+func reviewIgnored() int {
+	sel := 0
+	for {
+		keys := ignored.Keys()
+		if len(keys) == 0 {
+			if _, quit := displayMessage("No pairs are ignored.\nPress N in the deduplicator\nto ignore one."); quit {
+				return LOOP_QUIT
+			}
+			return LOOP_CONT
+		}
+		ls := make([]string, 0, len(keys)+1)
+		for _, k := range keys {
+			v := ignored.pairs[k]
+			ls = append(ls, v.A+"  &  "+v.B)
+		}
+		ls = append(ls, "Clear all")
+		if sel >= len(ls) {
+			sel = len(ls) - 1
+		}
+		menu := &IgnoredMenu{ChoiceMenu: makeMenu(ls, sel), keys: keys}
+		action := stdEventLoop(menu)
+		menu.destroy()
+		if action != LOOP_REDO {
+			if action == LOOP_QUIT {
+				return LOOP_QUIT
+			}
+			return LOOP_CONT
+		}
+		sel = menu.Selected
+	}
+}
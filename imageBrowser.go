@@ -20,14 +20,16 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"slices"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/veandco/go-sdl2/img"
 	"github.com/veandco/go-sdl2/sdl"
 )
@@ -39,6 +41,7 @@ type ImageBrowser interface {
 	modY(int32)
 	stopAnim()
 	imageLoader() int
+	setNotice(string)
 }
 
 type ImageMenu struct {
@@ -47,82 +50,125 @@ type ImageMenu struct {
 	ChoiceMenu
 	shouldReload bool
 	prevMoveDir  bool
+	sortMode     uint16
+	reverseSort  bool
+	notice       string
+	noticeTime   time.Time
+	// Unfiltered item list, nil if there is no filter
+	allItems  []string
+	filter    string
+	recursive bool
+	watched   []string
+	// The folder bar, if there is one
+	bar *FolderBar
+	// The tag bar replaces the folder bar while tagging. tagFor is the image whose tags it shows.
+	tagBar  *FolderBar
+	tagging bool
+	tagFor  string
+	// Draws the image instead of the usual copy, if set
+	drawImage func()
 }
 
 var flingOffsets = []int32{36, 43, 51, 62, 77, 95, 120, 152, 196, 255, 336, 449, 610, 840}
 
-func makeImageMenu(fldr string) (*ImageMenu, bool) {
-	var entries []os.DirEntry
-	var err error
-	if config.SizeSort == 0 {
-		entries, err = os.ReadDir(fldr)
-	} else {
-		// Avoid sorting by name if we are going to sort by size anyway.
-		// I love pointless microoptimizations!
-		var f *os.File
-		f, err = os.Open(fldr)
+func isSupportedImage(name string) bool {
+	ind := strings.LastIndexByte(name, '.')
+	if ind == -1 {
+		return false
+	}
+	switch strings.ToLower(name[ind+1:]) {
+	case "mp4":
+		fallthrough
+	case "webm":
+		fallthrough
+	case "gif":
+		fallthrough
+	case "mov":
+		fallthrough
+	case "bmp":
+		fallthrough
+	case "jpg":
+		fallthrough
+	case "png":
+		fallthrough
+	case "jpeg":
+		return true
+	}
+	return false
+}
+
+// listImages lists the supported images in fldr, along with how many entries it has in total.
+// If recursive is set, images in subfolders are included as slash-separated paths relative to fldr.
+func listImages(fldr string, recursive bool) ([]string, int) {
+	if !recursive {
+		f, err := os.Open(fldr)
 		if err != nil {
 			panic(err)
 		}
-		entries, err = f.ReadDir(0)
+		// Don't bother having ReadDir sort by name, sortImages will do it if needed
+		entries, err := f.ReadDir(0)
 		f.Close()
-	}
-	if err != nil {
-		panic(err)
-	}
-	ls := make([]string, 0, len(entries))
-	var srtMap map[string]int64
-	if config.SizeSort != 0 {
-		srtMap = make(map[string]int64, len(entries))
-	}
-	for _, v := range entries {
-		if !v.IsDir() {
-			ind := strings.LastIndexByte(v.Name(), '.')
-			if ind == -1 {
-				continue
-			}
-			switch strings.ToLower(v.Name()[ind+1:]) {
-			case "mp4":
-				fallthrough
-			case "webm":
-				fallthrough
-			case "gif":
-				fallthrough
-			case "mov":
-				fallthrough
-			case "bmp":
-				fallthrough
-			case "jpg":
-				fallthrough
-			case "png":
-				fallthrough
-			case "jpeg":
+		if err != nil {
+			panic(err)
+		}
+		ls := make([]string, 0, len(entries))
+		for _, v := range entries {
+			if !v.IsDir() && isSupportedImage(v.Name()) {
 				ls = append(ls, v.Name())
-				if config.SizeSort != 0 {
-					info, _ := v.Info()
-					srtMap[v.Name()] = info.Size()
-				}
 			}
 		}
+		return ls, len(entries)
 	}
-	if config.SizeSort != 0 {
-		sort.Slice(ls, func(i, j int) bool { return srtMap[ls[i]] > srtMap[ls[j]] })
-	}
-	if config.ReverseSort != 0 {
-		slices.Reverse(ls)
+	ls := make([]string, 0, 128)
+	count := 0
+	err := filepath.WalkDir(fldr, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == fldr {
+			return nil
+		}
+		count++
+		if d.IsDir() {
+			if d.Name()[0] == '.' || d.Name()[0] == '$' {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isSupportedImage(d.Name()) {
+			rel, _ := filepath.Rel(fldr, p)
+			ls = append(ls, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
 	}
+	return ls, count
+}
+
+func makeImageMenu(fldr string, recursive bool) (*ImageMenu, bool) {
+	ls, count := listImages(fldr, recursive)
+	sortImages(fldr, ls, config.SortMode, config.ReverseSort != 0)
 	menu := new(ImageMenu)
 	menu.fldr = fldr
 	menu.itemList = ls
+	menu.sortMode = config.SortMode
+	menu.reverseSort = config.ReverseSort != 0
+	menu.recursive = recursive
 	if len(ls) == 0 {
 		var quit bool
-		if len(entries) == 0 {
+		if count == 0 {
 			_, quit = displayMessage("Folder " + fldr + "\nis empty.")
 		} else {
 			_, quit = displayMessage("Folder " + fldr + "\nhas no supported images.")
 		}
 		return nil, quit
 	}
+	menu.watched = watchFolder(fldr, recursive)
+	if config.FolderBarAll != 0 && fldr != config.SortFolder && fldr != config.TrashFolder {
+		menu.bar = makeFolderBar(barTargets(fldr))
+	}
 	display.SetDrawColor(64, 64, 64, 0)
 	return menu, false
 }
@@ -133,6 +179,22 @@ func (menu *ImageMenu) destroy() {
 		menu.ffmpeg.Destroy()
 		menu.ffmpeg = nil
 	}
+	unwatchFolders(menu.watched)
+	menu.watched = nil
+	if menu.bar != nil {
+		menu.bar.destroy()
+	}
+	if menu.tagBar != nil {
+		menu.tagBar.destroy()
+	}
+	err := saveTags()
+	if err != nil {
+		panic(err)
+	}
+	err = saveRatings()
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (menu *ImageMenu) getHeight() int32 {
@@ -154,10 +216,172 @@ func (menu *ImageMenu) stopAnim() {
 	}
 }
 
+// uniqueName adds a number to name if there is already a file with that name in target, or it is in reserved.
+func uniqueName(target, name string, reserved map[string]bool) string {
+	taken := func(name string) bool {
+		_, err := os.Stat(filepath.Join(target, name))
+		return err == nil || reserved[name]
+	}
+	if !taken(name) {
+		return name
+	}
+	x := 0
+	dLoc := strings.IndexByte(name, '.')
+	before := name
+	var after string
+	if dLoc != -1 {
+		before = name[:dLoc]
+		after = name[dLoc+1:]
+	}
+	for taken(fmt.Sprintf("%s_%d.%s", before, x, after)) {
+		x++
+	}
+	return fmt.Sprintf("%s_%d.%s", before, x, after)
+}
+
+// moveInto moves a file into the folder target, adding a number to its name if there is already a file with that name.
+// If from is on another drive, it is copied and then removed. The new name is returned.
+func moveInto(from, target string) (string, error) {
+	return moveAs(from, target, filepath.Base(from))
+}
+
+// moveAs is moveInto, but the file is given a new name.
+func moveAs(from, target, name string) (string, error) {
+	newName := uniqueName(target, name, nil)
+	to := filepath.Join(target, newName)
+	err := os.Rename(from, to)
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		if _, err2 := os.Stat(from); err2 == nil {
+			err = copyFile(from, to)
+			if err == nil {
+				err = os.Remove(from)
+			}
+		}
+	}
+	return newName, err
+}
+
+// copyFile copies a file, keeping its modification time.
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
+
+// Ways of filing an image into a folder
+const (
+	FILE_MOVE = iota
+	FILE_COPY
+	FILE_LINK
+	FILE_SYMLINK
+)
+
+var fileActionNames = []string{"Moved", "Copied", "Linked", "Symlinked"}
+
+// fileAction picks how the folder bar files an image from the modifier keys being held.
+// Ctrl copies, Alt makes a hard link, and both make a symbolic link.
+func fileAction() int {
+	mods := sdl.GetModState()
+	ctrl := mods&sdl.KMOD_CTRL != 0
+	alt := mods&sdl.KMOD_ALT != 0
+	if ctrl && alt {
+		return FILE_SYMLINK
+	} else if ctrl {
+		return FILE_COPY
+	} else if alt {
+		return FILE_LINK
+	}
+	return FILE_MOVE
+}
+
+// fileInto is moveInto, but the file can also be copied or linked into target instead, leaving it where it is.
+// Symbolic links are relative, so they still work if the library is moved.
+func fileInto(from, target string, how int) (string, error) {
+	if how == FILE_MOVE {
+		return moveInto(from, target)
+	}
+	newName := uniqueName(target, filepath.Base(from), nil)
+	to := filepath.Join(target, newName)
+	var err error
+	switch how {
+	case FILE_COPY:
+		err = copyFile(from, to)
+	case FILE_LINK:
+		err = os.Link(from, to)
+	case FILE_SYMLINK:
+		var rel string
+		rel, err = filepath.Rel(target, from)
+		if err == nil {
+			err = os.Symlink(rel, to)
+		}
+	}
+	return newName, err
+}
+
+// fileImage is moveImage, but the image can also be copied or linked. The new path gets the same tags, rating and hash as the old one, and a copy of the sidecar.
+// Images are always moved to Trash.
+func fileImage(from, target string, how int) (string, error) {
+	if how == FILE_MOVE || target == config.TrashFolder {
+		return moveImage(from, target)
+	}
+	newName, err := fileInto(from, target, how)
+	if err != nil {
+		return newName, err
+	}
+	moveSidecar(from, filepath.Join(target, newName), true)
+	to := path.Join(filepath.ToSlash(target), newName)
+	hashes.Copy(filepath.ToSlash(from), to)
+	tags.Copy(filepath.ToSlash(from), to)
+	ratings.Copy(filepath.ToSlash(from), to)
+	return newName, nil
+}
+
+// moveImage moves an image in the library into target. Its tags, rating, sidecar and hash go with it, but the hash is dropped if it is going to Trash.
+func moveImage(from, target string) (string, error) {
+	moveLock.Lock()
+	defer moveLock.Unlock()
+	newName, err := moveInto(from, target)
+	if err != nil {
+		return newName, err
+	}
+	// The image is where it should be even if its sidecar isn't, so errors here are ignored
+	moveSidecar(from, filepath.Join(target, newName), false)
+	to := path.Join(filepath.ToSlash(target), newName)
+	if target != config.TrashFolder {
+		hashes.Move(filepath.ToSlash(from), to)
+	} else {
+		hashes.Delete(filepath.ToSlash(from))
+	}
+	// Tags and ratings go to Trash too, so they come back if the image is restored
+	tags.Move(filepath.ToSlash(from), to)
+	ratings.Move(filepath.ToSlash(from), to)
+	return newName, nil
+}
+
 func moveFile(menu ImageBrowser, from, target string) int {
 	moveFactor := 0
 	for -menu.getHeight() < menu.getY() && menu.getY() < display.GetViewport().H {
-		if target != "Trash" {
+		if target != config.TrashFolder {
 			menu.modY(-flingOffsets[moveFactor])
 		} else {
 			menu.modY(flingOffsets[moveFactor])
@@ -170,33 +394,35 @@ func moveFile(menu ImageBrowser, from, target string) int {
 		delay()
 	}
 	menu.stopAnim()
-	newName := filepath.Base(from)
-	if _, err := os.Stat(filepath.Join(target, newName)); err == nil {
-		x := -1
-		dLoc := strings.IndexByte(newName, '.')
-		before := newName
-		var after string
-		if dLoc != -1 {
-			before = newName[:dLoc]
-			after = newName[dLoc+1:]
-		}
-		for ; err == nil; _, err = os.Stat(filepath.Join(target, fmt.Sprintf("%s_%d.%s", before, x, after))) {
-			x++
-		}
-		newName = fmt.Sprintf("%s_%d.%s", before, x, after)
-	}
-	os.Rename(from, filepath.Join(target, newName))
-	if target != "Trash" {
-		hashes[path.Join(target, newName)] = hashes[from]
-	}
-	delete(hashes, filepath.ToSlash(from))
+	_, err := moveImage(from, target)
 	ret := menu.imageLoader()
+	// The image flew off the screen, but it is still where it was
+	if err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), []string{"Could not move image:"}))
+		if quit {
+			return LOOP_QUIT
+		}
+	}
 	menu.renderer()
 	display.Present()
 	return ret
 }
 
 func (menu *ImageMenu) keyHandler(key sdl.Keycode) int {
+	if ret, ok := menu.ratingKeys(key); ok {
+		return ret
+	}
+	if ret, ok := menu.tagKeys(key); ok {
+		return ret
+	}
+	if menu.bar != nil && !menu.tagging {
+		target, ret, ok := menu.bar.keyHandler(key)
+		if target != "" {
+			return menu.bar.moveTo(menu, filepath.Join(menu.fldr, menu.itemList[menu.Selected]), target)
+		} else if ok {
+			return ret
+		}
+	}
 	switch key {
 	case sdl.K_LEFT:
 		if menu.Selected > 0 {
@@ -236,9 +462,9 @@ func (menu *ImageMenu) keyHandler(key sdl.Keycode) int {
 		menu.renderer()
 		fadeScreen()
 	case sdl.K_x:
-		return moveFile(menu, filepath.Join(menu.fldr, menu.itemList[menu.Selected]), "Sort")
+		return moveFile(menu, filepath.Join(menu.fldr, menu.itemList[menu.Selected]), config.SortFolder)
 	case sdl.K_c:
-		return moveFile(menu, filepath.Join(menu.fldr, menu.itemList[menu.Selected]), "Trash")
+		return moveFile(menu, filepath.Join(menu.fldr, menu.itemList[menu.Selected]), config.TrashFolder)
 	case sdl.K_F3:
 		var sy, sx int32
 		wW, wH := window.GetSize()
@@ -267,6 +493,57 @@ func (menu *ImageMenu) keyHandler(key sdl.Keycode) int {
 		display.SetDrawColor(64, 64, 64, 0)
 		menu.renderer()
 		fadeScreen()
+	case sdl.K_o:
+		if sdl.GetModState()&sdl.KMOD_CTRL != 0 {
+			menu.reverseSort = !menu.reverseSort
+		} else if sdl.GetModState()&sdl.KMOD_SHIFT != 0 {
+			if menu.sortMode == 0 {
+				menu.sortMode = uint16(len(sortModeNames))
+			}
+			menu.sortMode--
+		} else {
+			menu.sortMode++
+			if int(menu.sortMode) >= len(sortModeNames) {
+				menu.sortMode = 0
+			}
+		}
+		menu.resort()
+	case sdl.K_f:
+		items := menu.itemList
+		if menu.allItems != nil {
+			items = menu.allItems
+		}
+		old := menu.filter
+		str := promptFilter(menu.filter, menu.fldr, items, menu, menu.previewFilter)
+		if str == "\x00" {
+			return LOOP_QUIT
+		}
+		if str != menu.filter {
+			ok, quit := menu.applyFilter(str)
+			if quit {
+				return LOOP_QUIT
+			} else if !ok {
+				// Put back what was there before the prompt, not the last filter that was previewed
+				menu.previewFilter(old)
+			}
+		}
+		saveScreen()
+		display.SetDrawColor(64, 64, 64, 0)
+		menu.renderer()
+		fadeScreen()
+	case sdl.K_m:
+		if browseSimilar(path.Join(filepath.ToSlash(menu.fldr), menu.itemList[menu.Selected]), nil) == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		// The current image may have been moved from the results
+		ret := menu.imageLoader()
+		if ret != LOOP_CONT {
+			return ret
+		}
+		saveScreen()
+		display.SetDrawColor(64, 64, 64, 0)
+		menu.renderer()
+		fadeScreen()
 	case sdl.K_v:
 		viewFile(filepath.Join(menu.fldr, menu.itemList[menu.Selected]))
 	case sdl.K_h:
@@ -277,11 +554,198 @@ func (menu *ImageMenu) keyHandler(key sdl.Keycode) int {
 	return LOOP_CONT
 }
 
+// applyFilter narrows the item list to images matching str, or removes the filter if str is empty.
+// If the filter is invalid or nothing matches, the list is left alone and false is returned.
+func (menu *ImageMenu) applyFilter(str string) (bool, bool) {
+	f, err := parseFilter(str)
+	if err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), []string{"Invalid filter:"}))
+		return false, quit
+	}
+	if !menu.setFilter(str, f) {
+		_, quit := displayMessage("No images match\n" + str)
+		return false, quit
+	}
+	return true, false
+}
+
+// previewFilter is applyFilter without any messages, for filtering while the filter is typed.
+func (menu *ImageMenu) previewFilter(str string) bool {
+	f, err := parseFilter(str)
+	return err == nil && menu.setFilter(str, f)
+}
+
+// setFilter narrows the item list to images matching f, keeping the current image selected if it matches.
+// If nothing matches, the list is left alone and false is returned.
+func (menu *ImageMenu) setFilter(str string, f *imageFilter) bool {
+	all := menu.allItems
+	if all == nil {
+		all = menu.itemList
+	}
+	cur := menu.itemList[menu.Selected]
+	if str == "" {
+		menu.itemList = all
+		menu.allItems = nil
+	} else {
+		ls := f.apply(menu.fldr, all)
+		if len(ls) == 0 {
+			return false
+		}
+		menu.itemList = ls
+		menu.allItems = all
+	}
+	menu.filter = str
+	menu.Selected = 0
+	for k, v := range menu.itemList {
+		if v == cur {
+			menu.Selected = k
+			break
+		}
+	}
+	if menu.itemList[menu.Selected] != cur {
+		menu.imageLoader()
+	}
+	return true
+}
+
+// resort sorts the item list again after the sort mode changes, keeping the current image selected.
+func (menu *ImageMenu) resort() {
+	cur := menu.itemList[menu.Selected]
+	sortImages(menu.fldr, menu.itemList, menu.sortMode, menu.reverseSort)
+	if menu.allItems != nil {
+		sortImages(menu.fldr, menu.allItems, menu.sortMode, menu.reverseSort)
+	}
+	for k, v := range menu.itemList {
+		if v == cur {
+			menu.Selected = k
+			break
+		}
+	}
+	if menu.reverseSort {
+		menu.setNotice("Sort: " + sortModeNames[menu.sortMode] + " (reversed)")
+	} else {
+		menu.setNotice("Sort: " + sortModeNames[menu.sortMode])
+	}
+	display.SetDrawColor(64, 64, 64, 0)
+}
+
+// refresh updates the list if something else changed the folder, keeping the current image selected.
+func (menu *ImageMenu) refresh() int {
+	if menu.applyChanges() {
+		return menu.imageLoader()
+	}
+	return LOOP_CONT
+}
+
+// applyChanges takes images that were removed out of the list and adds new ones to the end, so the list isn't sorted again.
+// It returns true if the current image has to be loaded again.
+func (menu *ImageMenu) applyChanges() bool {
+	changes := takeChanges(menu.fldr, menu.recursive)
+	if len(changes) == 0 {
+		return false
+	}
+	invalidateHashes(changes)
+	cur := ""
+	if menu.Selected < len(menu.itemList) {
+		cur = menu.itemList[menu.Selected]
+	}
+	all := menu.itemList
+	if menu.allItems != nil {
+		all = menu.allItems
+	}
+	have := make(map[string]bool, len(all))
+	for _, v := range all {
+		have[v] = true
+	}
+	removed := make(map[string]bool)
+	var added []string
+	for k := range changes {
+		k = path.Clean(k)
+		rel := k
+		if menu.fldr != "." {
+			rel = strings.TrimPrefix(k, menu.fldr+"/")
+		}
+		info, err := os.Stat(k)
+		if err != nil {
+			removed[rel] = true
+		} else if info.IsDir() {
+			// A new folder's images only show up when browsing subfolders
+			name := info.Name()
+			if !menu.recursive || name[0] == '.' || name[0] == '$' {
+				continue
+			}
+			if !slices.Contains(menu.watched, k) {
+				menu.watched = append(menu.watched, watchFolder(k, true)...)
+			}
+			ls, _ := listImages(k, true)
+			for _, v := range ls {
+				v = path.Join(rel, v)
+				if !have[v] {
+					added = append(added, v)
+					have[v] = true
+				}
+			}
+		} else if isSupportedImage(rel) && !have[rel] {
+			added = append(added, rel)
+			have[rel] = true
+		}
+	}
+	gone := func(s string) bool {
+		if removed[s] {
+			return true
+		}
+		// Removing a folder removes everything in it
+		if menu.recursive {
+			for k := range removed {
+				if inFolder(s, k) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	sortImages(menu.fldr, added, menu.sortMode, menu.reverseSort)
+	oldLen := len(all)
+	all = append(slices.DeleteFunc(all, gone), added...)
+	if oldLen != len(all) {
+		menu.setNotice(fmt.Sprintf("Folder changed, %d images", len(all)))
+	}
+	if menu.allItems != nil {
+		menu.allItems = all
+		f, _ := parseFilter(menu.filter)
+		menu.itemList = append(slices.DeleteFunc(menu.itemList, gone), f.apply(menu.fldr, added)...)
+	} else {
+		menu.itemList = all
+	}
+	for k, v := range menu.itemList {
+		if v == cur {
+			menu.Selected = k
+			return changes[path.Join(menu.fldr, cur)].Has(fsnotify.Write)
+		}
+	}
+	// The current image is gone
+	if menu.Selected >= len(menu.itemList) {
+		menu.Selected = len(menu.itemList) - 1
+	}
+	if menu.Selected < 0 {
+		menu.Selected = 0
+	}
+	return true
+}
+
+// setNotice shows a short message at the bottom of the browser for a few seconds.
+func (menu *ImageMenu) setNotice(s string) {
+	menu.notice = s
+	menu.noticeTime = time.Now()
+}
+
 func (menu *ImageMenu) imageLoader() int {
 	if len(menu.itemList) == 0 {
 		menu.animated = false
 		return LOOP_EXIT
 	}
+	// Other programs may have changed the image's keywords
+	loadXmp(menu.tagPath())
 	_, _, sx, sy, _ := loading.Query()
 	// On some systems, just trying to blit loading will cause a black screen or flash a previous frame
 	// Need to copy fadeFg under it
@@ -433,9 +897,23 @@ func (menu *ImageMenu) renderer() {
 			menu.image.Unlock()
 		}
 	}
-	display.Copy(menu.image, nil, menu.pos)
+	if menu.drawImage != nil {
+		menu.drawImage()
+	} else {
+		display.Copy(menu.image, nil, menu.pos)
+	}
+	if menu.tagging {
+		menu.renderTagBar()
+	} else if menu.bar != nil {
+		menu.bar.renderer()
+	}
 	wW, wH := window.GetSize()
-	posIndic, err := font.RenderUTF8Shaded(fmt.Sprintf("%d/%d", menu.Selected+1, len(menu.itemList)), COLOR_BLACK, COLOR_WHITE)
+	posText := fmt.Sprintf("%d/%d", menu.Selected+1, len(menu.itemList))
+	if menu.allItems != nil {
+		posText = fmt.Sprintf("%d/%d of %d", menu.Selected+1, len(menu.itemList), len(menu.allItems))
+	}
+	menu.renderRating()
+	posIndic, err := font.RenderUTF8Shaded(posText, COLOR_BLACK, COLOR_WHITE)
 	if err != nil {
 		panic(err)
 	}
@@ -444,7 +922,11 @@ func (menu *ImageMenu) renderer() {
 	posIndic.Free()
 	posInTxt.Destroy()
 	_, _, iW, iH, _ := menu.image.Query()
-	posIndic, err = font.RenderUTF8Shaded(fmt.Sprintf("%dx%d", iW, iH), COLOR_BLACK, COLOR_WHITE)
+	dimText := fmt.Sprintf("%dx%d", iW, iH)
+	if status := indexerStatus(); status != "" {
+		dimText += "  " + status
+	}
+	posIndic, err = font.RenderUTF8Shaded(dimText, COLOR_BLACK, COLOR_WHITE)
 	if err != nil {
 		panic(err)
 	}
@@ -452,6 +934,20 @@ func (menu *ImageMenu) renderer() {
 	display.Copy(posInTxt, nil, &sdl.Rect{Y: wH - posIndic.H, H: posIndic.H, W: posIndic.W})
 	posIndic.Free()
 	posInTxt.Destroy()
+	if menu.notice != "" {
+		if time.Since(menu.noticeTime) > 3*time.Second {
+			menu.notice = ""
+			return
+		}
+		posIndic, err = font.RenderUTF8Shaded(menu.notice, COLOR_BLACK, COLOR_WHITE)
+		if err != nil {
+			panic(err)
+		}
+		posInTxt, _ = display.CreateTextureFromSurface(posIndic)
+		display.Copy(posInTxt, nil, &sdl.Rect{X: (wW - posIndic.W) / 2, Y: wH - posIndic.H, H: posIndic.H, W: posIndic.W})
+		posIndic.Free()
+		posInTxt.Destroy()
+	}
 }
 
 type TrashMenu struct {
@@ -459,7 +955,7 @@ type TrashMenu struct {
 }
 
 func makeTrashMenu() (*TrashMenu, bool) {
-	men, quit := makeImageMenu("Trash")
+	men, quit := makeImageMenu(config.TrashFolder, false)
 	if men == nil || quit {
 		return nil, quit
 	}
@@ -475,9 +971,15 @@ func (men *TrashMenu) keyHandler(key sdl.Keycode) int {
 				men.ffmpeg.Destroy()
 				men.ffmpeg = nil
 			}
-			err := os.RemoveAll("Trash")
+			err := os.RemoveAll(config.TrashFolder)
+			emptied := func(p string) bool {
+				_, err := os.Stat(p)
+				return inFolder(p, config.TrashFolder) && os.IsNotExist(err)
+			}
+			tags.DeleteIf(emptied)
+			ratings.DeleteIf(emptied)
 			if err == nil {
-				os.Mkdir("Trash", 0644)
+				os.MkdirAll(config.TrashFolder, 0700)
 				if _, quit := displayMessage("Trash emptied."); quit {
 					return LOOP_QUIT
 				}
@@ -500,165 +1002,120 @@ func (men *TrashMenu) keyHandler(key sdl.Keycode) int {
 
 type SortMenu struct {
 	*ImageMenu
-	folders      []string
-	folderBar    *sdl.Texture
-	folderBarPos []int
-	folderBarInd int
-	showBar      bool
+	// Cached hashes of each folder on the bar, and the hash of the image the suggestions are for
+	known     map[string][][]byte
+	curHash   []byte
+	suggested string
 }
 
 func makeSortMenu(folders []string) (*SortMenu, bool) {
-	innerMenu, quit := makeImageMenu("Sort")
+	innerMenu, quit := makeImageMenu(config.SortFolder, false)
 	if innerMenu == nil || quit {
 		return nil, quit
 	}
-	men := &SortMenu{ImageMenu: innerMenu, folders: folders, showBar: len(folders) > 0}
-	if men.showBar {
-		men.folderBarPos = make([]int, 1, (len(folders)+4)/5+1)
-		keys := []byte{'1', '2', '3', '4', '5', '6', '7', '8', '9', '0', '-', '='}
-		curPos := 0
-		spaces, _, _ := font.SizeUTF8(" ")
-		spaces /= 2
-		totalLen := int32(spaces)
-		for k, v := range folders {
-			v = fmt.Sprintf(" %c %s ", keys[curPos], v)
-			fW, _, _ := font.SizeUTF8(v)
-			fW32 := int32(fW)
-			if fW32+totalLen > display.GetViewport().W || curPos+1 == len(keys) {
-				if curPos+1 == len(keys) {
-					k++
-				}
-				men.folderBarPos = append(men.folderBarPos, k)
-				totalLen = int32(spaces)
-				curPos = 0
-			}
-			curPos++
-			totalLen += fW32
-		}
-		if curPos > 1 || len(folders) == 1 {
-			men.folderBarPos = append(men.folderBarPos, len(folders))
-		}
+	innerMenu.bar = makeFolderBar(folders)
+	return &SortMenu{ImageMenu: innerMenu}, false
+}
+
+// The suggestions are worked out again when the current image changes
+func (men *SortMenu) refresh() int {
+	if men.applyChanges() {
+		return men.imageLoader()
 	}
-	return men, false
+	return LOOP_CONT
 }
 
 func (men *SortMenu) imageLoader() int {
-	if men.showBar && men.folderBar == nil {
-		men.loadFolderBar(-1)
+	ret := men.ImageMenu.imageLoader()
+	if men.suggest() {
+		men.bar.load(-1)
 	}
-	return men.ImageMenu.imageLoader()
+	return ret
 }
 
-func (men *SortMenu) loadFolderBar(highlight int) {
-	keys := []byte{'1', '2', '3', '4', '5', '6', '7', '8', '9', '0', '-', '='}
-	var totalLen int32
-	pxFmt, _ := window.GetPixelFormat()
-	barSurf, err := sdl.CreateRGBSurfaceWithFormat(0, display.GetViewport().W, int32(font.Height())*6/5, 32, pxFmt)
-	if err != nil {
-		panic(err)
+// suggest works out which folders the current image looks like it belongs in. It returns true if the suggestions changed.
+func (men *SortMenu) suggest() bool {
+	old := men.bar.marked
+	men.curHash, men.bar.marked, men.suggested = nil, nil, ""
+	if len(men.itemList) != 0 {
+		men.suggested = men.itemList[men.Selected]
 	}
-	barSurf.FillRect(nil, 0xFFFFFF)
-	barS := men.folderBarPos[men.folderBarInd]
-	barE := men.folderBarPos[men.folderBarInd+1]
-	for k, v := range men.folders[barS:barE] {
-		v = fmt.Sprintf(" %c %s ", keys[k], v)
-		fW, _, _ := font.SizeUTF8(v)
-		if highlight == k {
-			// barSurf.FillRect(&sdl.Rect{H: int32(font.Height()), W: fW32, X: totalLen, Y: int32(font.Height()) / 10}, 0xC1DDF3)
-			txtSurf, err := font.RenderUTF8Shaded(v, COLOR_BLACK, COLOR_BLUE)
-			if err != nil {
-				panic(err)
-			}
-			txtSurf.Blit(nil, barSurf, &sdl.Rect{X: totalLen, Y: int32(font.Height()) / 10})
-			txtSurf.Free()
-			// drawText(v, barSurf, totalLen, int32(font.Height())/10)
-		} else {
-			drawText(v, barSurf, totalLen, 0)
+	if config.SuggestFolders != 0 && len(men.bar.folders) != 0 && len(men.itemList) != 0 {
+		if men.known == nil {
+			men.known = folderHashes(men.bar.folders)
+		}
+		hsh, err := getHash(path.Join(filepath.ToSlash(men.fldr), men.itemList[men.Selected]))
+		if err == nil {
+			men.curHash = hsh
+			men.bar.marked = suggestFolders(hsh, men.known)
 		}
-		totalLen += int32(fW)
-	}
-	barSurf2, err := sdl.CreateRGBSurfaceWithFormat(0, display.GetViewport().W, int32(font.Height())*6/5, 32, pxFmt)
-	if err != nil {
-		panic(err)
 	}
-	barSurf2.FillRect(nil, 0xFFFFFF)
-	spaces, _, _ := font.SizeUTF8(" ")
-	barSurf.Blit(nil, barSurf2, &sdl.Rect{H: int32(font.Height()) * 6 / 5, W: display.GetViewport().W, X: (display.GetViewport().W - totalLen - int32(spaces)) / 2})
-	barSurf.Free()
-	men.folderBar, err = display.CreateTextureFromSurface(barSurf2)
-	if err != nil {
-		panic(err)
+	return !slices.Equal(old, men.bar.marked)
+}
+
+// moveTo moves the current image into one of the folders on the bar.
+func (men *SortMenu) moveTo(targetFldr string) int {
+	// The image's hash now counts towards its new folder
+	if men.known != nil && men.curHash != nil && men.suggested == men.itemList[men.Selected] {
+		men.known[targetFldr] = append(men.known[targetFldr], men.curHash)
 	}
-	barSurf2.Free()
+	return men.bar.moveTo(men, filepath.Join(men.fldr, men.itemList[men.Selected]), targetFldr)
 }
 
 func (men *SortMenu) keyHandler(key sdl.Keycode) int {
-	if key == sdl.K_MINUS || key == sdl.K_EQUALS || (key >= sdl.K_0 && key <= sdl.K_9) {
-		if !men.showBar {
-			return LOOP_CONT
-		}
-		var pos int
-		switch key {
-		case sdl.K_MINUS:
-			pos = 10
-		case sdl.K_EQUALS:
-			pos = 11
-		case sdl.K_0:
-			pos = 9
-		default:
-			pos = int(key) - 49
-		}
-		barS := men.folderBarPos[men.folderBarInd]
-		barE := men.folderBarPos[men.folderBarInd+1]
-		if barS+pos >= barE {
-			return LOOP_CONT
-		}
-		targetFldr := men.folders[barS+pos]
-		men.loadFolderBar(pos)
-		ret := moveFile(men, filepath.Join(men.fldr, men.itemList[men.Selected]), targetFldr)
-		men.loadFolderBar(-1)
-		return ret
+	if !men.tagging {
+		target, ret, ok := men.bar.keyHandler(key)
+		if target != "" {
+			return men.moveTo(target)
+		} else if ok {
+			return ret
+		}
 	}
 	switch key {
 	case sdl.K_x:
-	case sdl.K_q:
-		if !men.showBar {
-			men.showBar = true
-		} else {
-			if sdl.GetModState()&sdl.KMOD_SHIFT != 0 {
-				men.folderBarInd--
-				if men.folderBarInd < 0 {
-					men.folderBarInd = len(men.folderBarPos) - 2
-				}
-			} else {
-				men.folderBarInd++
-				if men.folderBarInd >= len(men.folderBarPos)-1 {
-					men.folderBarInd = 0
-				}
-			}
-			men.loadFolderBar(-1)
+	case sdl.K_c:
+		// Through the SortMenu, so the suggestions follow the next image
+		return moveFile(men, filepath.Join(men.fldr, men.itemList[men.Selected]), config.TrashFolder)
+	case sdl.K_RETURN:
+		// Accept the best suggestion
+		if len(men.bar.marked) != 0 && men.suggested == men.itemList[men.Selected] {
+			return men.moveTo(men.bar.marked[0])
 		}
-	case sdl.K_i:
-		men.showBar = !men.showBar
-	default:
-		ret := men.ImageMenu.keyHandler(key)
-		if ret == LOOP_CONT && men.showBar {
-			display.Copy(men.folderBar, nil, &sdl.Rect{H: int32(font.Height()) * 6 / 5, W: display.GetViewport().W})
-			display.Present()
+	case sdl.K_r:
+		ret := men.previewRules()
+		if ret != LOOP_CONT {
+			return ret
 		}
-		return ret
+		men.bar.load(-1)
+		saveScreen()
+		display.SetDrawColor(64, 64, 64, 0)
+		men.renderer()
+		fadeScreen()
+	default:
+		return men.ImageMenu.keyHandler(key)
 	}
 	return LOOP_CONT
 }
 
 func (menu *SortMenu) renderer() {
+	if menu.shouldReload {
+		menu.imageLoader()
+		menu.shouldReload = false
+	} else if len(menu.itemList) != 0 && menu.itemList[menu.Selected] != menu.suggested {
+		// The image was changed without going through imageLoader, like with G
+		if menu.suggest() {
+			menu.bar.load(-1)
+		}
+	}
 	menu.ImageMenu.renderer()
-	if menu.showBar {
-		display.Copy(menu.folderBar, nil, &sdl.Rect{H: int32(font.Height()) * 6 / 5, W: display.GetViewport().W})
+	if menu.bar.show && len(menu.bar.marked) != 0 && !menu.tagging {
+		surf, err := font.RenderUTF8Shaded("Enter - "+strings.Join(menu.bar.marked, ", "), COLOR_BLACK, COLOR_SUGGEST)
+		if err != nil {
+			panic(err)
+		}
+		txt, _ := display.CreateTextureFromSurface(surf)
+		display.Copy(txt, nil, &sdl.Rect{Y: barHeight(), H: surf.H, W: surf.W})
+		surf.Free()
+		txt.Destroy()
 	}
 }
-
-func (menu *SortMenu) destroy() {
-	menu.ImageMenu.destroy()
-	menu.folderBar.Destroy()
-}
@@ -0,0 +1,381 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jlortiz0/ImageSort/cache"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// The import log is kept next to the config
+const IMPORT_LOG = "imgImport.log"
+
+const (
+	IMPORT_COPIED = iota
+	IMPORT_MOVED
+	IMPORT_DUPLICATE
+	IMPORT_FAILED
+)
+
+var importActions = []string{"copied", "moved", "duplicate", "failed"}
+
+var errImportCancelled = errors.New("import cancelled")
+
+// importResult is what happened to one file. For a duplicate, dest is the file it duplicates.
+type importResult struct {
+	action int
+	src    string
+	dest   string
+	err    error
+}
+
+// importSizePrint identifies a file by its size and fingerprint, as a quick check before comparing contents.
+type importSizePrint struct {
+	size int64
+	fp   uint64
+}
+
+// importIndex finds files that are already in the library by their contents. Trash is left out.
+// Files that are up to date in the cache use its fingerprint, and the rest are fingerprinted, so files that were never hashed are found too.
+type importIndex map[importSizePrint][]string
+
+func makeImportIndex() importIndex {
+	index := make(importIndex)
+	ls, _ := listImages(".", true)
+	for _, p := range ls {
+		if inFolder(p, config.TrashFolder) {
+			continue
+		}
+		if e, ok := hashes.Get(p); ok && e.Size != 0 {
+			if info, err := os.Stat(p); err == nil && info.ModTime().Unix() == e.ModTime && info.Size() == e.Size {
+				index.add(p, e.Size, e.Fingerprint)
+				continue
+			}
+		}
+		size, fp, err := cache.Fingerprint(p)
+		if err == nil {
+			index.add(p, size, fp)
+		}
+	}
+	return index
+}
+
+func (index importIndex) add(p string, size int64, fp uint64) {
+	key := importSizePrint{size, fp}
+	index[key] = append(index[key], p)
+}
+
+// find returns a file with the same contents as the file at p, or an empty string.
+func (index importIndex) find(p string, size int64, fp uint64) string {
+	for _, v := range index[importSizePrint{size, fp}] {
+		if sameContents(p, v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// sameContents compares two files byte by byte.
+func sameContents(a, b string) bool {
+	f1, err := os.Open(a)
+	if err != nil {
+		return false
+	}
+	defer f1.Close()
+	f2, err := os.Open(b)
+	if err != nil {
+		return false
+	}
+	defer f2.Close()
+	r1 := bufio.NewReaderSize(f1, 64*1024)
+	r2 := bufio.NewReaderSize(f2, 64*1024)
+	buf1 := make([]byte, 32*1024)
+	buf2 := make([]byte, 32*1024)
+	for {
+		n1, err1 := io.ReadFull(r1, buf1)
+		n2, err2 := io.ReadFull(r2, buf2)
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false
+		}
+		if err1 != nil || err2 != nil {
+			return err1 == err2
+		}
+	}
+}
+
+// importName works out the name for an imported file from pattern.
+// %Y, %m, %d, %H, %M and %S are replaced with parts of the date taken, %n with the original name without its extension, and %% with %.
+// The original extension is always kept. An empty pattern keeps the original name.
+func importName(pattern, p string) string {
+	name := filepath.Base(p)
+	if pattern == "" {
+		return name
+	}
+	ext := filepath.Ext(name)
+	// Reading the date can mean opening the file, so only do it if the pattern uses it
+	var t time.Time
+	date := func() time.Time {
+		if t.IsZero() {
+			t = dateTaken(p)
+		}
+		return t
+	}
+	var out strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i == len(pattern)-1 {
+			out.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			fmt.Fprintf(&out, "%04d", date().Year())
+		case 'm':
+			fmt.Fprintf(&out, "%02d", date().Month())
+		case 'd':
+			fmt.Fprintf(&out, "%02d", date().Day())
+		case 'H':
+			fmt.Fprintf(&out, "%02d", date().Hour())
+		case 'M':
+			fmt.Fprintf(&out, "%02d", date().Minute())
+		case 'S':
+			fmt.Fprintf(&out, "%02d", date().Second())
+		case 'n':
+			out.WriteString(strings.TrimSuffix(name, ext))
+		default:
+			out.WriteByte(pattern[i])
+		}
+	}
+	// The pattern can't put files in subfolders
+	newName := strings.NewReplacer("/", "_", "\\", "_").Replace(out.String())
+	if newName == "" {
+		return name
+	}
+	return newName + ext
+}
+
+// checkImportSource makes src absolute and makes sure it is outside the library.
+// Images already in the library are moved with the folder bar instead, which keeps their hashes, tags and ratings.
+func checkImportSource(src string) (string, error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", errors.New(src + " is not a folder")
+	}
+	for _, v := range [][2]string{{src, library.root}, {library.root, src}} {
+		if rel, err := filepath.Rel(v[0], v[1]); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", errors.New("can't import from a folder containing or inside the library")
+		}
+	}
+	return src, nil
+}
+
+// importFolder brings every supported image in src and its subfolders into the Sort folder.
+// Files whose contents are already in the library are skipped. If dry is set, nothing is changed, but the results are the same.
+// progress is called before each file, and the import stops if it returns false.
+// src must have been checked by checkImportSource.
+func importFolder(src string, move, dry bool, pattern string, progress func(i, total int) bool) ([]importResult, error) {
+	ls, _ := listImages(src, true)
+	if !dry {
+		err := os.MkdirAll(config.SortFolder, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	index := makeImportIndex()
+	// Names given out in a dry run, since the files aren't actually created
+	reserved := make(map[string]bool)
+	results := make([]importResult, 0, len(ls))
+	for i, v := range ls {
+		if progress != nil && !progress(i, len(ls)) {
+			return results, errImportCancelled
+		}
+		p := filepath.Join(src, filepath.FromSlash(v))
+		res := importResult{src: p}
+		size, fp, err := cache.Fingerprint(p)
+		if err != nil {
+			res.action = IMPORT_FAILED
+			res.err = err
+			results = append(results, res)
+			continue
+		}
+		if dup := index.find(p, size, fp); dup != "" {
+			res.action = IMPORT_DUPLICATE
+			res.dest = dup
+			results = append(results, res)
+			continue
+		}
+		name := importName(pattern, p)
+		if dry {
+			name = uniqueName(config.SortFolder, name, reserved)
+			reserved[name] = true
+		} else if move {
+			name, err = moveAs(p, config.SortFolder, name)
+		} else {
+			name = uniqueName(config.SortFolder, name, nil)
+			err = copyFile(p, filepath.Join(config.SortFolder, name))
+		}
+		res.dest = path.Join(config.SortFolder, name)
+		res.action = IMPORT_COPIED
+		if move {
+			res.action = IMPORT_MOVED
+		}
+		if err != nil {
+			res.action = IMPORT_FAILED
+			res.err = err
+		} else if dry {
+			// Later files can still be duplicates of this one
+			index.add(p, size, fp)
+		} else {
+			index.add(res.dest, size, fp)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// writeImportLog adds a run of importFolder to the end of the import log.
+// Each file gets a line with the time, what happened, where it came from, and where it went or what it duplicates, separated by tabs.
+func writeImportLog(src string, results []importResult) error {
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(library.configPath), IMPORT_LOG), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	now := time.Now().Format(time.RFC3339)
+	counts := importCounts(results)
+	fmt.Fprintf(w, "# %s import from %s: %d imported, %d duplicates, %d failed\n", now, src, counts[IMPORT_COPIED]+counts[IMPORT_MOVED], counts[IMPORT_DUPLICATE], counts[IMPORT_FAILED])
+	for _, v := range results {
+		dest := v.dest
+		if v.err != nil {
+			dest = v.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", now, importActions[v.action], v.src, dest)
+	}
+	err = w.Flush()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func importCounts(results []importResult) []int {
+	counts := make([]int, len(importActions))
+	for _, v := range results {
+		counts[v.action]++
+	}
+	return counts
+}
+
+// doImport asks for a folder to import from, then imports it into the Sort folder using the settings in the config.
+func doImport() int {
+	src := createNewFolder("")
+	if src == "\x00" {
+		return LOOP_QUIT
+	} else if src == "" {
+		return LOOP_CONT
+	}
+	src, err := checkImportSource(src)
+	if err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), []string{"Can't import:"}))
+		if quit {
+			return LOOP_QUIT
+		}
+		return LOOP_CONT
+	}
+	verb := "Copy"
+	if config.ImportMove != 0 {
+		verb = "Move"
+	}
+	b, quit := displayMessage(wordWrapper(src, []string{verb + " new images from"}) + "\ninto " + config.SortFolder + "?\nZ - Yes  X - No")
+	if quit {
+		return LOOP_QUIT
+	} else if !b {
+		return LOOP_CONT
+	}
+	// The indexer would race the import for files in Sort
+	stopIndexer()
+	defer startIndexer()
+	saveScreen()
+	texture, rect := drawMessage("Importing...\nPreparing...")
+	display.Clear()
+	display.Copy(texture, nil, rect)
+	fadeScreen()
+	lastUpdate := time.Now()
+	lastPump := time.Now()
+	results, err := importFolder(src, config.ImportMove != 0, false, config.ImportRename, func(i, total int) bool {
+		if time.Since(lastUpdate) > time.Second/4 {
+			texture.Destroy()
+			texture, rect = drawMessage(fmt.Sprintf("Importing...\n%d of %d", i, total))
+			display.Clear()
+			display.Copy(texture, nil, rect)
+			display.Present()
+			lastUpdate = time.Now()
+		}
+		if time.Since(lastPump) > time.Second/16 {
+			for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+				if keyEvent, ok := event.(*sdl.KeyboardEvent); ok && keyEvent.Keysym.Sym == sdl.K_ESCAPE {
+					return false
+				}
+			}
+			lastPump = time.Now()
+		}
+		return true
+	})
+	texture.Destroy()
+	if results == nil && err != nil {
+		_, quit := displayMessage(wordWrapper(err.Error(), []string{"Error importing:"}))
+		if quit {
+			return LOOP_QUIT
+		}
+		return LOOP_CONT
+	}
+	msg := "Import finished."
+	if err != nil {
+		msg = "Import cancelled."
+	}
+	counts := importCounts(results)
+	msg += fmt.Sprintf("\n%d imported\n%d already in library\n%d failed", counts[IMPORT_COPIED]+counts[IMPORT_MOVED], counts[IMPORT_DUPLICATE], counts[IMPORT_FAILED])
+	if err := writeImportLog(src, results); err != nil {
+		msg += "\nCould not write " + IMPORT_LOG
+	} else {
+		msg += "\nSee " + IMPORT_LOG + " for details."
+	}
+	_, quit = displayMessage(msg)
+	if quit {
+		return LOOP_QUIT
+	}
+	return LOOP_CONT
+}
@@ -0,0 +1,57 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportName(t *testing.T) {
+	// Without EXIF, the date taken is the modification time
+	p := filepath.Join(t.TempDir(), "IMG_0042.JPG")
+	err := os.WriteFile(p, []byte("not an image"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)
+	err = os.Chtimes(p, date, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pattern string
+		out     string
+	}{
+		{"", "IMG_0042.JPG"},
+		{"%n", "IMG_0042.JPG"},
+		{"%Y-%m-%d %H.%M.%S", "2021-03-04 05.06.07.JPG"},
+		{"%Y/%m/%n", "2021_03_IMG_0042.JPG"},
+		{"a\\b", "a_b.JPG"},
+		{"100%% %n", "100% IMG_0042.JPG"},
+		// Unknown codes and a % at the end are kept as they are
+		{"%q%", "q%.JPG"},
+	}
+	for _, tt := range tests {
+		if got := importName(tt.pattern, p); got != tt.out {
+			t.Errorf("%q: got %q, expected %q", tt.pattern, got, tt.out)
+		}
+	}
+}
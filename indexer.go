@@ -0,0 +1,162 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// The indexer hashes the library in the background, so the DeDuplicator has less to do when it is started.
+// It waits while the user is doing something, and between files so it doesn't take over the CPU.
+var indexer struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+	// Unix milliseconds of the last key press
+	lastActive atomic.Int64
+	done       atomic.Int32
+	total      atomic.Int32
+}
+
+// moveLock is held while images are moved or swapped, and while a hash is stored.
+// Otherwise the indexer could store a hash under a path the image left while it was being decoded.
+var moveLock sync.Mutex
+
+const (
+	indexerIdle  = 1500 * time.Millisecond
+	indexerSleep = 10 * time.Millisecond
+)
+
+func startIndexer() {
+	if config.BackgroundHash == 0 || indexer.stop != nil {
+		return
+	}
+	indexer.stop = make(chan struct{})
+	indexer.done.Store(0)
+	indexer.total.Store(0)
+	indexer.wg.Add(1)
+	go indexLibrary(indexer.stop)
+}
+
+// stopIndexer stops the indexer and waits for it to finish the file it is on.
+// It has to be stopped before changing any config that affects hashes.
+func stopIndexer() {
+	if indexer.stop == nil {
+		return
+	}
+	close(indexer.stop)
+	indexer.wg.Wait()
+	indexer.stop = nil
+}
+
+// noteActivity pauses the indexer for a moment.
+func noteActivity() {
+	indexer.lastActive.Store(time.Now().UnixMilli())
+}
+
+// indexerStatus describes what the indexer is doing, or is empty if it isn't running.
+func indexerStatus() string {
+	if indexer.stop == nil {
+		return ""
+	}
+	done, total := indexer.done.Load(), indexer.total.Load()
+	if total == 0 || done == total {
+		return ""
+	}
+	if time.Since(time.UnixMilli(indexer.lastActive.Load())) < indexerIdle {
+		return fmt.Sprintf("Hashing paused %d/%d", done, total)
+	}
+	return fmt.Sprintf("Hashing %d/%d", done, total)
+}
+
+// indexerWait sleeps for d, then until the user has been idle for a while. It returns false if the indexer should stop.
+func indexerWait(stop chan struct{}, d time.Duration) bool {
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(d):
+		}
+		if time.Since(time.UnixMilli(indexer.lastActive.Load())) >= indexerIdle {
+			return true
+		}
+		d = indexerIdle / 4
+	}
+}
+
+// indexLibrary hashes every image in the library that isn't up to date in the cache.
+// Hashing doesn't touch SDL, and each video is decoded with its own libav context, so it is safe to do alongside the UI.
+func indexLibrary(stop chan struct{}) {
+	defer indexer.wg.Done()
+	ls := make([]string, 0, 128)
+	filepath.WalkDir(".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return nil
+		}
+		if d.IsDir() {
+			p = filepath.ToSlash(p)
+			if d.Name()[0] == '.' || d.Name()[0] == '$' || p == config.TrashFolder {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if isSupportedImage(d.Name()) {
+			ls = append(ls, filepath.ToSlash(p))
+		}
+		return nil
+	})
+	indexer.total.Store(int32(len(ls)))
+	for _, v := range ls {
+		if !indexerWait(stop, indexerSleep) {
+			return
+		}
+		// Skip anything that is already up to date without decoding it
+		if e, ok := hashes.Get(v); ok && e.Size != 0 {
+			if info, err := os.Stat(v); err == nil && info.ModTime().Unix() == e.ModTime {
+				indexer.done.Add(1)
+				continue
+			}
+		}
+		getHash(v)
+		indexer.done.Add(1)
+	}
+}
+
+// drawIndexerStatus shows the indexer's progress in the bottom left corner, if it is running.
+func drawIndexerStatus() {
+	status := indexerStatus()
+	if status == "" {
+		return
+	}
+	surf, err := font.RenderUTF8Shaded(status, COLOR_BLACK, COLOR_WHITE)
+	if err != nil {
+		panic(err)
+	}
+	txt, _ := display.CreateTextureFromSurface(surf)
+	_, wH := window.GetSize()
+	display.Copy(txt, nil, &sdl.Rect{Y: wH - surf.H, H: surf.H, W: surf.W})
+	surf.Free()
+	txt.Destroy()
+}
@@ -0,0 +1,241 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// The library is the folder of categories being sorted.
+// The working directory is changed to its root, so folder paths and cache keys are relative to it.
+// The config and cache are kept in the root unless somewhere else is asked for. Tags, ratings and ignored duplicates are always kept in the root.
+var library struct {
+	root        string
+	configPath  string
+	cachePath   string
+	tagsPath    string
+	ratingsPath string
+	ignoredPath string
+}
+
+const maxRecentLibraries = 10
+
+func openLibrary(root string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	err = os.Chdir(root)
+	if err != nil {
+		return err
+	}
+	library.root = root
+	if library.configPath == "" {
+		library.configPath = filepath.Join(root, "ImgSort.cfg")
+	}
+	if library.cachePath == "" {
+		library.cachePath = filepath.Join(root, "imgSort.cache")
+	}
+	library.tagsPath = filepath.Join(root, "imgSort.tags")
+	library.ratingsPath = filepath.Join(root, "imgSort.ratings")
+	library.ignoredPath = filepath.Join(root, "imgSort.ignored")
+	return nil
+}
+
+// inFolder is true if the slash-separated path p is somewhere inside dir.
+func inFolder(p, dir string) bool {
+	return strings.HasPrefix(p, dir+"/")
+}
+
+func setDefaultConfig() {
+	config.HashDiff = 12
+	config.HashSize = 8
+	config.FadeSpeed = 56
+	config.SuggestFolders = 1
+	config.FolderKeys = DEFAULT_FOLDER_KEYS
+	config.SortFolder = "Sort"
+	config.TrashFolder = "Trash"
+}
+
+func loadConfig() error {
+	data, err := os.ReadFile(library.configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return err
+	}
+	if config.SizeSort != 0 {
+		config.SortMode = SORT_SIZE
+		config.SizeSort = 0
+	}
+	// A hand-edited or newer config may name a mode this version doesn't have
+	for p, names := range optionsMenuNames {
+		if int(*p) >= len(names) {
+			*p = 0
+		}
+	}
+	// Sort and Trash may be anywhere in the library, but keep them in the same form as other folder paths
+	if config.SortFolder == "" {
+		config.SortFolder = "Sort"
+	}
+	if config.TrashFolder == "" {
+		config.TrashFolder = "Trash"
+	}
+	config.SortFolder = path.Clean(filepath.ToSlash(config.SortFolder))
+	config.TrashFolder = path.Clean(filepath.ToSlash(config.TrashFolder))
+	return nil
+}
+
+func saveConfig() error {
+	b, err := json.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(library.configPath, b, 0644)
+}
+
+func recentLibrariesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ImageSort", "libraries.json")
+}
+
+func loadRecentLibraries() []string {
+	p := recentLibrariesPath()
+	if p == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	var ls []string
+	json.Unmarshal(data, &ls)
+	return ls
+}
+
+func saveRecentLibraries(ls []string) {
+	p := recentLibrariesPath()
+	if p == "" {
+		return
+	}
+	b, err := json.Marshal(ls)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(p), 0700)
+	os.WriteFile(p, b, 0644)
+}
+
+// addRecentLibrary moves root to the top of the recent library list.
+func addRecentLibrary(root string) {
+	ls := loadRecentLibraries()
+	if ind := slices.Index(ls, root); ind != -1 {
+		ls = slices.Delete(ls, ind, ind+1)
+	}
+	ls = slices.Insert(ls, 0, root)
+	if len(ls) > maxRecentLibraries {
+		ls = ls[:maxRecentLibraries]
+	}
+	saveRecentLibraries(ls)
+}
+
+type LibraryMenu struct {
+	*ChoiceMenu
+	recent []string
+	chosen string
+}
+
+// pickLibrary asks which library to open. The working directory and any recent library can be picked, or a path typed in.
+// If nothing is picked, "" is returned.
+func pickLibrary() (string, bool) {
+	sel := 0
+LibraryRegen:
+	recent := loadRecentLibraries()
+	ls := make([]string, 0, len(recent)+2)
+	ls = append(ls, recent...)
+	ls = append(ls, "Current Folder", "Open...")
+	if sel >= len(ls) {
+		sel = len(ls) - 1
+	}
+	menu := &LibraryMenu{ChoiceMenu: makeMenu(ls, sel), recent: recent}
+	action := stdEventLoop(menu)
+	menu.destroy()
+	if action == LOOP_REDO {
+		sel = menu.Selected
+		goto LibraryRegen
+	}
+	return menu.chosen, action == LOOP_QUIT
+}
+
+func (menu *LibraryMenu) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_RETURN:
+		var p string
+		switch menu.Selected {
+		case len(menu.itemList) - 1:
+			p = createNewFolder("")
+			if p == "\x00" {
+				return LOOP_QUIT
+			} else if p == "" {
+				saveScreen()
+				menu.renderer()
+				fadeScreen()
+				return LOOP_CONT
+			}
+		case len(menu.itemList) - 2:
+			p = "."
+		default:
+			p = menu.recent[menu.Selected]
+		}
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			if _, quit := displayMessage(wordWrapper(p, []string{"Folder does not exist:"})); quit {
+				return LOOP_QUIT
+			}
+			saveScreen()
+			menu.renderer()
+			fadeScreen()
+			return LOOP_CONT
+		}
+		menu.chosen = p
+		return LOOP_EXIT
+	case sdl.K_d:
+		// Forget a recent library
+		if menu.Selected < len(menu.recent) {
+			saveRecentLibraries(slices.Delete(menu.recent, menu.Selected, menu.Selected+1))
+			return LOOP_REDO
+		}
+	default:
+		return menu.ChoiceMenu.keyHandler(key)
+	}
+	return LOOP_CONT
+}
@@ -18,7 +18,6 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"os"
 	"runtime/debug"
@@ -35,6 +34,8 @@ import (
 var COLOR_BLACK = sdl.Color{A: 255}
 var COLOR_WHITE = sdl.Color{R: 255, G: 255, B: 255, A: 255}
 var COLOR_BLUE = sdl.Color{R: 193, G: 221, B: 243, A: 255}
+var COLOR_SUGGEST = sdl.Color{R: 205, G: 238, B: 200, A: 255}
+var COLOR_REJECT = sdl.Color{R: 240, G: 196, B: 196, A: 255}
 
 var window *sdl.Window
 var display *sdl.Renderer
@@ -49,34 +50,51 @@ var config struct {
 	HashDiff    uint16
 	HashSize    uint16
 	AnimFrame   uint16
-	SizeSort    uint16
+	SortMode    uint16
 	ReverseSort uint16
+	IgnoreCase  uint16
+	NestedSort  uint16
+	// Hash the library in the background while browsing
+	BackgroundHash uint16
+	// Suggest folders on the Sort folder's bar
+	SuggestFolders uint16
+	// Move files when importing instead of copying them
+	ImportMove uint16
+	// Where tags and ratings are shared through XMP, one of the XMP_ modes
+	Xmp uint16
+	// Which duplicate the deduplicator treats as better, one of the KEEP_ policies
+	KeepPolicy uint16
+	// Replaced by SortMode, only read for old configs
+	SizeSort uint16 `json:",omitempty"`
+	// Locations of Sort and Trash relative to the library root
+	SortFolder  string
+	TrashFolder string
+	// How imported files are renamed, see importName
+	ImportRename string
+	// Rules for moving images out of Sort, checked in order
+	SortRules []SortRule `json:",omitempty"`
+	// The folder bar's keys, pinned folders, and folders by when they were last used
+	BarOrder      uint16
+	FolderBarAll  uint16
+	FolderKeys    string
+	PinnedFolders []string `json:",omitempty"`
+	RecentFolders []string `json:",omitempty"`
 }
 
 func main() {
-	if len(os.Args) > 1 {
-		os.Chdir(strings.Join(os.Args[1:], " "))
-	} else if _, err := os.Stat("jlortiz_TEST"); err == nil {
-		os.Chdir("jlortiz_TEST")
+	if parseArgs() {
+		return
 	}
-	data, err := os.ReadFile("ImgSort.cfg")
-	if err != nil {
-		config.HashDiff = 12
-		config.HashSize = 8
-		config.FadeSpeed = 56
-	} else {
-		err = json.Unmarshal(data, &config)
-		if err != nil {
-			panic(err)
+	setDefaultConfig()
+	root := cliArgs.root
+	if root == "" {
+		if _, err := os.Stat("jlortiz_TEST"); err == nil {
+			root = "jlortiz_TEST"
 		}
 	}
-	err = loadHashes()
-	if err != nil {
-		panic(err)
-	}
 	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "best")
 	sdl.SetHint(sdl.HINT_VIDEO_ALLOW_SCREENSAVER, "1")
-	err = sdl.Init(sdl.INIT_TIMER | sdl.INIT_VIDEO)
+	err := sdl.Init(sdl.INIT_TIMER | sdl.INIT_VIDEO)
 	if err != nil {
 		panic(err)
 	}
@@ -85,6 +103,9 @@ func main() {
 	sdl.EventState(sdl.KEYUP, sdl.DISABLE)
 
 	initWindow()
+	if cliArgs.fullscreen {
+		window.SetFullscreen(sdl.WINDOW_FULLSCREEN_DESKTOP)
+	}
 	defer window.Destroy()
 	defer display.Destroy()
 	hideConsole()
@@ -196,7 +217,49 @@ func main() {
 		}
 	}()
 	prevDelay = time.Now()
-	beginFldrMenu()
+	if root == "" {
+		if len(loadRecentLibraries()) == 0 {
+			root = "."
+		} else {
+			var quit bool
+			root, quit = pickLibrary()
+			if quit || root == "" {
+				return
+			}
+		}
+	}
+	err = openLibrary(root)
+	if err != nil {
+		panic(err)
+	}
+	addRecentLibrary(library.root)
+	err = loadConfig()
+	if err != nil {
+		panic(err)
+	}
+	err = loadHashes()
+	if err != nil {
+		panic(err)
+	}
+	err = loadTags()
+	if err != nil {
+		panic(err)
+	}
+	err = loadRatings()
+	if err != nil {
+		panic(err)
+	}
+	err = loadIgnored()
+	if err != nil {
+		panic(err)
+	}
+	initWatcher()
+	defer closeWatcher()
+	startIndexer()
+	if !startMode() {
+		beginFldrMenu()
+	}
+	stopIndexer()
 	saveScreen()
 	display.SetDrawColor(0, 0, 0, 0)
 	display.Clear()
@@ -205,6 +268,18 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	err = saveTags()
+	if err != nil {
+		panic(err)
+	}
+	err = saveRatings()
+	if err != nil {
+		panic(err)
+	}
+	err = saveIgnored()
+	if err != nil {
+		panic(err)
+	}
 }
 
 var prevDelay time.Time
@@ -325,6 +400,7 @@ func stdEventLoop(men Menu) int {
 				men.textInput(nil)
 				return LOOP_QUIT
 			case *sdl.KeyboardEvent:
+				noteActivity()
 				key := event.Keysym.Sym
 				if key == sdl.K_ESCAPE {
 					return LOOP_EXIT
@@ -348,6 +424,11 @@ func stdEventLoop(men Menu) int {
 				}
 			}
 		}
+		if r, ok := men.(Refresher); ok {
+			if resp := r.refresh(); resp != LOOP_CONT {
+				return resp
+			}
+		}
 		men.renderer()
 		display.Present()
 	}
@@ -0,0 +1,592 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/devedge/imagehash"
+	"github.com/jlortiz0/multisav/streamy"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Which image of a group of duplicates is kept when resolving them automatically
+const (
+	KEEP_BEST = iota
+	KEEP_RESOLUTION
+	KEEP_LARGEST
+	KEEP_SMALLEST
+	KEEP_SHARPEST
+	KEEP_OLDEST
+)
+
+var keepPolicyNames = []string{"Best Overall", "Resolution", "Largest File", "Smallest File", "Sharpness", "Oldest"}
+
+// Images are measured at no more than this many pixels across for sharpness, so images of different sizes can be compared
+const sharpnessSize = 512
+
+// Quality is what is known about how good a copy of an image is. Zero means unknown.
+type Quality struct {
+	W, H    int32
+	Size    int64
+	ModTime int64
+	Format  string
+	// Bits per second, for MP4 and MOV videos
+	Bitrate int64
+	// Estimated from the quantization tables, for JPEGs
+	JpegQuality int
+	// Variance of the Laplacian. Higher is sharper, but it only means anything next to another copy of the same image.
+	Sharpness float64
+}
+
+func (q Quality) String() string {
+	s := fmt.Sprintf("%dx%d  %s  %.1f MiB", q.W, q.H, q.Format, float64(q.Size)/1024/1024)
+	if q.Bitrate != 0 {
+		s += fmt.Sprintf("  %d kb/s", q.Bitrate/1000)
+	}
+	if q.JpegQuality != 0 {
+		s += fmt.Sprintf("  Q%d", q.JpegQuality)
+	}
+	if q.Sharpness != 0 {
+		s += fmt.Sprintf("  Sharpness %.0f", q.Sharpness)
+	}
+	return s
+}
+
+// measureQuality measures the image at p. Only the size and format are needed, the rest is left as unknown if it can't be found.
+func measureQuality(p string) (Quality, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return Quality{}, err
+	}
+	q := Quality{Size: info.Size(), ModTime: info.ModTime().Unix()}
+	q.Format = strings.ToUpper(strings.TrimPrefix(filepath.Ext(p), "."))
+	if q.Format == "JPG" {
+		q.Format = "JPEG"
+	}
+	q.W, q.H, _ = imageDimensions(p)
+	var img image.Image
+	if isAnimated(p) {
+		if duration, err := movieDuration(p); err == nil && duration > 0 {
+			q.Bitrate = int64(float64(q.Size*8) / duration.Seconds())
+		}
+		img, err = streamy.GetVideoFrame(p, int(config.AnimFrame))
+	} else {
+		if isJpeg(p) {
+			q.JpegQuality, _ = jpegQuality(p)
+		}
+		img, err = imagehash.OpenImg(p)
+	}
+	if err == nil {
+		q.Sharpness = sharpness(img)
+	}
+	return q, nil
+}
+
+// The luminance quantization table from the JPEG standard. Encoders like libjpeg scale it by the quality setting.
+var stdLuminanceTable = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+var errNoQuantTable = errors.New("no luminance quantization table")
+
+// jpegQuality estimates the quality setting a JPEG was saved with, from 1 to 100, by comparing its luminance table to the standard one.
+// This is exact for libjpeg and close enough for most other encoders.
+func jpegQuality(p string) (int, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	temp := make([]byte, 2)
+	_, err = io.ReadFull(reader, temp)
+	if err != nil {
+		return 0, err
+	}
+	if temp[0] != 0xFF || temp[1] != 0xD8 {
+		return 0, errNoQuantTable
+	}
+	for {
+		marker, size, err := nextJpegSegment(reader)
+		if err != nil {
+			return 0, err
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return 0, errNoQuantTable
+		}
+		if marker != 0xDB {
+			_, err = reader.Discard(size)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return 0, err
+		}
+		// One segment can hold more than one table
+		for len(data) > 0 {
+			wide := data[0]>>4 != 0
+			id := data[0] & 0xF
+			n := 64
+			if wide {
+				n = 128
+			}
+			if len(data) < n+1 {
+				return 0, errNoQuantTable
+			}
+			if id != 0 {
+				data = data[n+1:]
+				continue
+			}
+			var sum, stdSum int
+			for i := 0; i < 64; i++ {
+				if wide {
+					sum += int(binary.BigEndian.Uint16(data[1+i*2:]))
+				} else {
+					sum += int(data[1+i])
+				}
+				stdSum += stdLuminanceTable[i]
+			}
+			// Undo libjpeg's scaling
+			scale := float64(sum) * 100 / float64(stdSum)
+			var quality float64
+			if scale <= 100 {
+				quality = (200 - scale) / 2
+			} else {
+				quality = 5000 / scale
+			}
+			return clampInt(int(quality+0.5), 1, 100), nil
+		}
+	}
+}
+
+// movieDuration reads how long an MP4 or MOV is from its movie header.
+func movieDuration(p string) (time.Duration, error) {
+	ext := strings.ToLower(filepath.Ext(p))
+	if ext != ".mp4" && ext != ".mov" {
+		return 0, errors.ErrUnsupported
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// Boxes are found by skipping over the ones that aren't wanted, going into moov to find mvhd
+	end := info.Size()
+	var offset int64
+	temp := make([]byte, 16)
+	for offset+8 <= end {
+		_, err = f.ReadAt(temp[:8], offset)
+		if err != nil {
+			return 0, err
+		}
+		size := int64(binary.BigEndian.Uint32(temp))
+		kind := string(temp[4:8])
+		header := int64(8)
+		if size == 1 {
+			_, err = f.ReadAt(temp[8:16], offset+8)
+			if err != nil {
+				return 0, err
+			}
+			size = int64(binary.BigEndian.Uint64(temp[8:]))
+			header = 16
+		} else if size == 0 {
+			size = end - offset
+		}
+		if size < header {
+			break
+		}
+		switch kind {
+		case "moov":
+			end = offset + size
+			offset += header
+			continue
+		case "mvhd":
+			data := make([]byte, 32)
+			n, _ := f.ReadAt(data, offset+header)
+			if n < 20 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			var timescale, duration uint64
+			if data[0] == 1 {
+				if n < 32 {
+					return 0, io.ErrUnexpectedEOF
+				}
+				timescale = uint64(binary.BigEndian.Uint32(data[20:]))
+				duration = binary.BigEndian.Uint64(data[24:])
+			} else {
+				timescale = uint64(binary.BigEndian.Uint32(data[12:]))
+				duration = uint64(binary.BigEndian.Uint32(data[16:]))
+			}
+			if timescale == 0 {
+				return 0, errors.New("movie header has no timescale")
+			}
+			return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+		}
+		offset += size
+	}
+	return 0, errors.New("no movie header")
+}
+
+// sharpness measures how much detail an image has as the variance of the Laplacian of its brightness.
+// Blurry or upscaled copies score lower. The image is shrunk first so the score doesn't depend on its size.
+func sharpness(img image.Image) float64 {
+	b := img.Bounds()
+	if b.Dx() < 3 || b.Dy() < 3 {
+		return 0
+	}
+	fit := fitRect(int32(b.Dx()), int32(b.Dy()), sdl.Rect{W: sharpnessSize, H: sharpnessSize})
+	w, h := int(fit.W), int(fit.H)
+	if w > b.Dx() || h > b.Dy() {
+		w, h = b.Dx(), b.Dy()
+	}
+	if w < 3 || h < 3 {
+		return 0
+	}
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Average a few points in each block so detail isn't made up by skipping pixels
+			var sum float64
+			for _, d := range [4][2]int{{1, 1}, {3, 1}, {1, 3}, {3, 3}} {
+				sx := b.Min.X + (x*4+d[0])*b.Dx()/(w*4)
+				sy := b.Min.Y + (y*4+d[1])*b.Dy()/(h*4)
+				r, g, bl, _ := img.At(sx, sy).RGBA()
+				sum += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+			}
+			gray[y*w+x] = sum / 4
+		}
+	}
+	var sum, sumSq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			l := gray[i-1] + gray[i+1] + gray[i-w] + gray[i+w] - 4*gray[i]
+			sum += l
+			sumSq += l * l
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
+
+// within is true if a and b are within frac of each other, so the difference is too small to matter.
+func within(a, b, frac float64) bool {
+	return a == b || (a-b)/max(a, b) < frac && (b-a)/max(a, b) < frac
+}
+
+// compareQuality says which of two copies is better under policy: positive if a, negative if b, and 0 if they are as good as each other.
+// Other policies fall back to Best Overall when they can't decide.
+func compareQuality(a, b Quality, policy uint16) int {
+	switch policy {
+	case KEEP_RESOLUTION:
+		if pa, pb := int64(a.W)*int64(a.H), int64(b.W)*int64(b.H); pa != pb {
+			return cmpInt64(pa, pb)
+		}
+	case KEEP_LARGEST:
+		if a.Size != b.Size {
+			return cmpInt64(a.Size, b.Size)
+		}
+	case KEEP_SMALLEST:
+		if a.Size != b.Size {
+			return cmpInt64(b.Size, a.Size)
+		}
+	case KEEP_SHARPEST:
+		if a.Sharpness != b.Sharpness {
+			return cmpFloat(a.Sharpness, b.Sharpness)
+		}
+	case KEEP_OLDEST:
+		if a.ModTime != b.ModTime {
+			return cmpInt64(b.ModTime, a.ModTime)
+		}
+	}
+	// Best Overall goes by pixels, then how much the image was compressed, then sharpness, then file size.
+	// Small differences are ignored so a slightly bigger or sharper copy doesn't win over a much better one.
+	if pa, pb := float64(a.W)*float64(a.H), float64(b.W)*float64(b.H); !within(pa, pb, 0.01) {
+		return cmpFloat(pa, pb)
+	}
+	if a.JpegQuality != 0 && b.JpegQuality != 0 && absInt(a.JpegQuality-b.JpegQuality) >= 3 {
+		return a.JpegQuality - b.JpegQuality
+	}
+	if a.Bitrate != 0 && b.Bitrate != 0 && !within(float64(a.Bitrate), float64(b.Bitrate), 0.05) {
+		return cmpInt64(a.Bitrate, b.Bitrate)
+	}
+	if !within(a.Sharpness, b.Sharpness, 0.1) {
+		return cmpFloat(a.Sharpness, b.Sharpness)
+	}
+	return cmpInt64(a.Size, b.Size)
+}
+
+func cmpInt64(a, b int64) int {
+	if a > b {
+		return 1
+	} else if a < b {
+		return -1
+	}
+	return 0
+}
+
+func cmpFloat(a, b float64) int {
+	if a > b {
+		return 1
+	} else if a < b {
+		return -1
+	}
+	return 0
+}
+
+// getQuality measures the image at p in the deduplicator's folder, or returns the measurement from before.
+func (menu *DiffMenu) getQuality(p string) Quality {
+	if q, ok := menu.quality[p]; ok {
+		return q
+	}
+	if menu.quality == nil {
+		menu.quality = make(map[string]Quality)
+	}
+	q, _ := measureQuality(filepath.Join(menu.fldr, p))
+	menu.quality[p] = q
+	return q
+}
+
+// renderQuality shows what is known about both images of the pair above the dimensions, highlighting the better one.
+func (menu *DiffMenu) renderQuality() {
+	if len(menu.diffList) == 0 {
+		return
+	}
+	pair := menu.diffList[menu.Selected]
+	qa, qb := menu.getQuality(pair[0]), menu.getQuality(pair[1])
+	better := compareQuality(qa, qb, config.KeepPolicy)
+	_, wH := window.GetSize()
+	for k, q := range [2]Quality{qa, qb} {
+		s := fmt.Sprintf("%c: %s", 'A'+k, q)
+		if k == menu.imageSel {
+			s = "> " + s
+		}
+		bg := COLOR_WHITE
+		if (k == 0 && better > 0) || (k == 1 && better < 0) {
+			bg = COLOR_SUGGEST
+		}
+		surf, err := font.RenderUTF8Shaded(s, COLOR_BLACK, bg)
+		if err != nil {
+			panic(err)
+		}
+		txt, _ := display.CreateTextureFromSurface(surf)
+		display.Copy(txt, nil, &sdl.Rect{Y: wH - surf.H*int32(3-k), H: surf.H, W: surf.W})
+		surf.Free()
+		txt.Destroy()
+	}
+}
+
+// groupDuplicates splits the images in pairs into groups where every image is paired with every other one.
+// Groups aren't chained together through a shared image, since A can look like B and B like C while A looks nothing like C.
+// Images are put in the first group they fit, and an image that fits none starts a new one. Groups of one image are left out.
+func groupDuplicates(pairs [][2]string) [][]string {
+	paired := make(map[[2]string]bool, len(pairs)*2)
+	var order []string
+	seen := make(map[string]bool)
+	for _, v := range pairs {
+		paired[v] = true
+		paired[[2]string{v[1], v[0]}] = true
+		for _, s := range v {
+			if !seen[s] {
+				seen[s] = true
+				order = append(order, s)
+			}
+		}
+	}
+	var groups [][]string
+Outer:
+	for _, s := range order {
+		for k, group := range groups {
+			fits := true
+			for _, v := range group {
+				if !paired[[2]string{s, v}] {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				groups[k] = append(group, s)
+				continue Outer
+			}
+		}
+		groups = append(groups, []string{s})
+	}
+	return slices.DeleteFunc(groups, func(v []string) bool { return len(v) < 2 })
+}
+
+// DuplicatesMenu lists the groups resolveDuplicates found, so they can be checked before anything is sent to Trash.
+// Each group has the image that will be kept first. The last entry applies them.
+type DuplicatesMenu struct {
+	*ChoiceMenu
+	groups  [][]string
+	applied bool
+}
+
+func (menu *DuplicatesMenu) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_RETURN:
+		if menu.Selected == len(menu.groups) {
+			menu.applied = true
+			return LOOP_EXIT
+		}
+	case sdl.K_d:
+		// Leave a group alone
+		if menu.Selected < len(menu.groups) {
+			menu.groups = slices.Delete(menu.groups, menu.Selected, menu.Selected+1)
+			return LOOP_REDO
+		}
+	default:
+		return menu.ChoiceMenu.keyHandler(key)
+	}
+	return LOOP_CONT
+}
+
+// resolveDuplicates keeps the best image of each group of duplicates, by the Keep Best option, and sends the rest to Trash.
+// The groups are listed first, and any of them can be left alone.
+func (menu *DiffMenu) resolveDuplicates() int {
+	found := groupDuplicates(menu.diffList)
+	if len(found) == 0 {
+		return LOOP_CONT
+	}
+	total := 0
+	for _, v := range found {
+		total += len(v)
+	}
+	saveScreen()
+	texture, rect := drawMessage("Comparing duplicates...\nMeasuring...")
+	display.Clear()
+	display.Copy(texture, nil, rect)
+	fadeScreen()
+	lastUpdate := time.Now()
+	groups := make([][]string, 0, len(found))
+	done := 0
+	for _, group := range found {
+		best := 0
+		for k, s := range group[1:] {
+			if compareQuality(menu.getQuality(s), menu.getQuality(group[best]), config.KeepPolicy) > 0 {
+				best = k + 1
+			}
+		}
+		ordered := make([]string, 0, len(group))
+		ordered = append(ordered, group[best])
+		ordered = append(ordered, group[:best]...)
+		ordered = append(ordered, group[best+1:]...)
+		groups = append(groups, ordered)
+		done += len(group)
+		if time.Since(lastUpdate) > time.Second/4 {
+			texture.Destroy()
+			texture, rect = drawMessage(fmt.Sprintf("Comparing duplicates...\nMeasuring %.1f%%", float32(done)/float32(total)*100))
+			display.Clear()
+			display.Copy(texture, nil, rect)
+			display.Present()
+			lastUpdate = time.Now()
+			for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+				keyEvent, ok := event.(*sdl.KeyboardEvent)
+				if ok && keyEvent.Keysym.Sym == sdl.K_ESCAPE {
+					texture.Destroy()
+					return LOOP_CONT
+				}
+			}
+		}
+	}
+	texture.Destroy()
+	sel := 0
+	var list *DuplicatesMenu
+	for {
+		ls := make([]string, 0, len(groups)+1)
+		losers := 0
+		for _, v := range groups {
+			ls = append(ls, fmt.Sprintf("Keep %s, trash %s", v[0], strings.Join(v[1:], ", ")))
+			losers += len(v) - 1
+		}
+		ls = append(ls, fmt.Sprintf("Keep the best by %s from %d groups, and send %d images to Trash", keepPolicyNames[config.KeepPolicy], len(groups), losers))
+		if sel >= len(ls) {
+			sel = len(ls) - 1
+		}
+		list = &DuplicatesMenu{ChoiceMenu: makeMenu(ls, sel), groups: groups}
+		action := stdEventLoop(list)
+		list.destroy()
+		if action == LOOP_QUIT {
+			return LOOP_QUIT
+		} else if action != LOOP_REDO {
+			break
+		}
+		sel = list.Selected
+		groups = list.groups
+	}
+	if !list.applied || len(list.groups) == 0 {
+		return LOOP_CONT
+	}
+	var losers []string
+	for _, v := range list.groups {
+		losers = append(losers, v[1:]...)
+	}
+	menu.stopAnim()
+	var errs []error
+	for _, v := range losers {
+		_, err := moveImage(filepath.Join(menu.fldr, v), config.TrashFolder)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		_, quit := displayMessage(wordWrapper(errors.Join(errs...).Error(), []string{fmt.Sprintf("%d images could not be moved:", len(errs))}))
+		if quit {
+			return LOOP_QUIT
+		}
+	}
+	gone := func(v [2]string) bool {
+		_, err := os.Stat(filepath.Join(menu.fldr, v[0]))
+		_, err2 := os.Stat(filepath.Join(menu.fldr, v[1]))
+		return os.IsNotExist(err) || os.IsNotExist(err2)
+	}
+	menu.diffList = slices.DeleteFunc(menu.diffList, gone)
+	if menu.allPairs != nil {
+		menu.allPairs = slices.DeleteFunc(menu.allPairs, gone)
+	}
+	menu.itemList = make([]string, len(menu.diffList))
+	menu.Selected = 0
+	return menu.imageLoader()
+}
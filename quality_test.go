@@ -0,0 +1,49 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupDuplicates(t *testing.T) {
+	tests := []struct {
+		name   string
+		pairs  [][2]string
+		groups [][]string
+	}{
+		{"none", nil, nil},
+		{"one pair", [][2]string{{"a", "b"}}, [][]string{{"a", "b"}}},
+		{"separate pairs", [][2]string{{"a", "b"}, {"c", "d"}}, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"triangle", [][2]string{{"a", "b"}, {"b", "c"}, {"a", "c"}}, [][]string{{"a", "b", "c"}}},
+		// b is like both, but a and c aren't alike, so c is left out
+		{"chain", [][2]string{{"a", "b"}, {"b", "c"}}, [][]string{{"a", "b"}}},
+		{"chain of pairs", [][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}}, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"reversed pair", [][2]string{{"a", "b"}, {"c", "b"}, {"c", "a"}}, [][]string{{"a", "b", "c"}}},
+	}
+	for _, tt := range tests {
+		groups := groupDuplicates(tt.pairs)
+		if len(groups) == 0 && len(tt.groups) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%s: got %v, expected %v", tt.name, groups, tt.groups)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+const (
+	FLAG_NONE = iota
+	FLAG_PICK
+	FLAG_REJECT
+)
+
+// Rating is the verdict on an image from culling: 0 to 5 stars, and whether it is a pick or a reject.
+type Rating struct {
+	Stars int `json:",omitempty"`
+	Flag  int `json:",omitempty"`
+}
+
+func (r Rating) String() string {
+	s := strings.Repeat("*", r.Stars)
+	switch r.Flag {
+	case FLAG_PICK:
+		s = strings.TrimSpace(s + " Pick")
+	case FLAG_REJECT:
+		s = strings.TrimSpace(s + " Reject")
+	}
+	return s
+}
+
+// xmpRating is the rating as XMP has it. Rejects are -1, like Lightroom and darktable do.
+func (r Rating) xmpRating() int {
+	if r.Flag == FLAG_REJECT {
+		return -1
+	}
+	return r.Stars
+}
+
+// RatingStore keeps the rating of each image, keyed like the tags.
+type RatingStore struct {
+	ratings map[string]Rating
+	dirty   bool
+}
+
+// Use path for keys to ratings, not filepath
+var ratings = &RatingStore{ratings: make(map[string]Rating)}
+
+func loadRatings() error {
+	ratings = &RatingStore{ratings: make(map[string]Rating)}
+	data, err := os.ReadFile(library.ratingsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &ratings.ratings)
+}
+
+// saveRatings writes the ratings if they have changed since they were loaded.
+func saveRatings() error {
+	if !ratings.dirty {
+		return nil
+	}
+	b, err := json.Marshal(ratings.ratings)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(library.ratingsPath, b, 0644)
+	if err == nil {
+		ratings.dirty = false
+	}
+	return err
+}
+
+// Get returns the rating of the image at p, and whether it has one.
+func (rs *RatingStore) Get(p string) (Rating, bool) {
+	r, ok := rs.ratings[p]
+	return r, ok
+}
+
+// Set changes the rating of the image at p. A rating of no stars and no flag is removed, so the image counts as unrated.
+func (rs *RatingStore) Set(p string, r Rating) {
+	if old, ok := rs.ratings[p]; ok && old == r {
+		return
+	}
+	if r == (Rating{}) {
+		delete(rs.ratings, p)
+	} else {
+		rs.ratings[p] = r
+	}
+	rs.dirty = true
+}
+
+// Move moves the rating of from to to.
+func (rs *RatingStore) Move(from, to string) {
+	r, ok := rs.ratings[from]
+	if !ok || from == to {
+		return
+	}
+	delete(rs.ratings, from)
+	rs.ratings[to] = r
+	rs.dirty = true
+}
+
+// Copy gives to the same rating as from.
+func (rs *RatingStore) Copy(from, to string) {
+	r, ok := rs.ratings[from]
+	if !ok || from == to {
+		return
+	}
+	rs.ratings[to] = r
+	rs.dirty = true
+}
+
+// Swap swaps the ratings of two paths.
+func (rs *RatingStore) Swap(a, b string) {
+	ra, okA := rs.ratings[a]
+	rb, okB := rs.ratings[b]
+	if !okA && !okB {
+		return
+	}
+	delete(rs.ratings, a)
+	delete(rs.ratings, b)
+	if okA {
+		rs.ratings[b] = ra
+	}
+	if okB {
+		rs.ratings[a] = rb
+	}
+	rs.dirty = true
+}
+
+// DeleteIf removes the rating of every path that f returns true for.
+func (rs *RatingStore) DeleteIf(f func(string) bool) {
+	for k := range rs.ratings {
+		if f(k) {
+			delete(rs.ratings, k)
+			rs.dirty = true
+		}
+	}
+}
+
+// ratingKeys handles the rating keys: Shift + 0 to 5 for stars, [ to reject and ] to pick.
+// Pressing [ or ] again takes the flag off. It returns false if key isn't one of them.
+func (menu *ImageMenu) ratingKeys(key sdl.Keycode) (int, bool) {
+	var change func(r Rating) Rating
+	switch {
+	case key >= sdl.K_0 && key <= sdl.K_5 && sdl.GetModState()&sdl.KMOD_SHIFT != 0:
+		stars := int(key - sdl.K_0)
+		change = func(r Rating) Rating {
+			r.Stars = stars
+			return r
+		}
+	case key == sdl.K_LEFTBRACKET || key == sdl.K_RIGHTBRACKET:
+		flag := FLAG_REJECT
+		if key == sdl.K_RIGHTBRACKET {
+			flag = FLAG_PICK
+		}
+		change = func(r Rating) Rating {
+			if r.Flag == flag {
+				r.Flag = FLAG_NONE
+			} else {
+				r.Flag = flag
+			}
+			return r
+		}
+	default:
+		return LOOP_CONT, false
+	}
+	if len(menu.itemList) == 0 {
+		return LOOP_CONT, true
+	}
+	p := menu.tagPath()
+	if !filepath.IsLocal(filepath.FromSlash(p)) {
+		// Only images in the library can be rated
+		return LOOP_CONT, true
+	}
+	r, _ := ratings.Get(p)
+	r = change(r)
+	ratings.Set(p, r)
+	if r == (Rating{}) {
+		menu.setNotice("Unrated")
+	} else {
+		menu.setNotice("Rated " + r.String())
+	}
+	if err := syncXmp(p); err != nil {
+		if _, quit := displayMessage(wordWrapper(err.Error(), []string{"Could not write XMP:"})); quit {
+			return LOOP_QUIT, true
+		}
+	}
+	return LOOP_CONT, true
+}
+
+// renderRating draws the current image's rating above the position in the bottom right.
+func (menu *ImageMenu) renderRating() {
+	if len(menu.itemList) == 0 {
+		return
+	}
+	r, ok := ratings.Get(menu.tagPath())
+	if !ok {
+		return
+	}
+	bg := COLOR_WHITE
+	if r.Flag == FLAG_PICK {
+		bg = COLOR_SUGGEST
+	} else if r.Flag == FLAG_REJECT {
+		bg = COLOR_REJECT
+	}
+	surf, err := font.RenderUTF8Shaded(" "+r.String()+" ", COLOR_BLACK, bg)
+	if err != nil {
+		panic(err)
+	}
+	txt, _ := display.CreateTextureFromSurface(surf)
+	wW, wH := window.GetSize()
+	display.Copy(txt, nil, &sdl.Rect{X: wW - surf.W, Y: wH - surf.H*2, H: surf.H, W: surf.W})
+	surf.Free()
+	txt.Destroy()
+}
+
+// CullMenu shows only the images in a folder that haven't been rated yet. Rating an image takes it out of the list.
+// When the culling is done, the rejects can all be sent to Trash.
+type CullMenu struct {
+	*ImageMenu
+}
+
+// unrated is true if the image at p doesn't have any stars or a flag.
+func unrated(p string) bool {
+	_, ok := ratings.Get(p)
+	return !ok
+}
+
+func makeCullMenu(fldr string) (*CullMenu, bool) {
+	innerMenu, quit := makeImageMenu(fldr, false)
+	if innerMenu == nil {
+		return nil, quit
+	}
+	innerMenu.itemList = slices.DeleteFunc(innerMenu.itemList, func(s string) bool { return !unrated(path.Join(fldr, s)) })
+	if len(innerMenu.itemList) == 0 {
+		innerMenu.destroy()
+		// There may still be rejects left from last time
+		return nil, finishCull(fldr) == LOOP_QUIT
+	}
+	return &CullMenu{innerMenu}, false
+}
+
+func (menu *CullMenu) keyHandler(key sdl.Keycode) int {
+	ret, ok := menu.ratingKeys(key)
+	if !ok {
+		// Moving to another image may have loaded a rating from its XMP
+		ret = menu.ImageMenu.keyHandler(key)
+	}
+	if ret != LOOP_CONT || len(menu.itemList) == 0 || unrated(menu.tagPath()) {
+		return ret
+	}
+	return menu.dropCurrent()
+}
+
+// imageLoader skips images that turn out to be rated once their XMP is read.
+func (menu *CullMenu) imageLoader() int {
+	ret := menu.ImageMenu.imageLoader()
+	if ret != LOOP_CONT || len(menu.itemList) == 0 || unrated(menu.tagPath()) {
+		return ret
+	}
+	return menu.dropCurrent()
+}
+
+// dropCurrent takes the current image out of the list now that it is rated, and loads the next one.
+func (menu *CullMenu) dropCurrent() int {
+	menu.itemList = slices.Delete(menu.itemList, menu.Selected, menu.Selected+1)
+	if menu.allItems != nil {
+		menu.allItems = slices.DeleteFunc(menu.allItems, func(s string) bool { return !unrated(path.Join(menu.fldr, s)) })
+	}
+	if menu.Selected >= len(menu.itemList) {
+		menu.Selected = max(len(menu.itemList)-1, 0)
+	}
+	menu.stopAnim()
+	return menu.imageLoader()
+}
+
+// Rated images don't come back when the folder changes
+func (menu *CullMenu) refresh() int {
+	ret := menu.ImageMenu.refresh()
+	before := len(menu.itemList)
+	menu.itemList = slices.DeleteFunc(menu.itemList, func(s string) bool { return !unrated(path.Join(menu.fldr, s)) })
+	if len(menu.itemList) != before {
+		if menu.Selected >= len(menu.itemList) {
+			menu.Selected = max(len(menu.itemList)-1, 0)
+		}
+		return menu.imageLoader()
+	}
+	return ret
+}
+
+// cullFolder culls a folder, then offers to send its rejects to Trash.
+func cullFolder(fldr string) int {
+	menu, quit := makeCullMenu(fldr)
+	if quit {
+		return LOOP_QUIT
+	}
+	if menu == nil {
+		return LOOP_CONT
+	}
+	menu.imageLoader()
+	if stdEventLoop(menu) == LOOP_QUIT {
+		return LOOP_QUIT
+	}
+	menu.destroy()
+	return finishCull(fldr)
+}
+
+// finishCull asks whether to send the rejects in fldr to Trash, if there are any.
+func finishCull(fldr string) int {
+	ls, _ := listImages(fldr, false)
+	ls = slices.DeleteFunc(ls, func(s string) bool {
+		r, _ := ratings.Get(path.Join(fldr, s))
+		return r.Flag != FLAG_REJECT
+	})
+	if len(ls) == 0 {
+		return LOOP_CONT
+	}
+	b, quit := displayMessage(fmt.Sprintf("Send %d rejected images\nto Trash?\nZ - Yes  X - No", len(ls)))
+	if quit {
+		return LOOP_QUIT
+	} else if !b {
+		return LOOP_CONT
+	}
+	var errs []error
+	for _, v := range ls {
+		_, err := moveImage(filepath.Join(fldr, v), config.TrashFolder)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		_, quit := displayMessage(wordWrapper(errors.Join(errs...).Error(), []string{fmt.Sprintf("%d images could not be moved:", len(errs))}))
+		if quit {
+			return LOOP_QUIT
+		}
+	}
+	return LOOP_CONT
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// SortRule sends images in the Sort folder that match Filter to Folder.
+// Filter uses the same terms as the image browser's filter, and Folder is relative to the library root.
+type SortRule struct {
+	Filter string
+	Folder string
+}
+
+// plannedMove is an image in the Sort folder that a rule would move.
+type plannedMove struct {
+	name   string
+	folder string
+	rule   int
+}
+
+// planAutoSort finds the first rule that matches each image in ls.
+// Images that don't match any rule are left out.
+func planAutoSort(fldr string, ls []string) ([]plannedMove, error) {
+	filters := make([]*imageFilter, len(config.SortRules))
+	for k, v := range config.SortRules {
+		f, err := parseFilter(v.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", k+1, err)
+		}
+		folder := path.Clean(filepath.ToSlash(v.Folder))
+		if v.Folder == "" || folder == "." || folder == config.SortFolder || inFolder(folder, config.SortFolder) || folder == ".." || path.IsAbs(folder) || inFolder(folder, "..") {
+			return nil, fmt.Errorf("rule %d: bad folder %q", k+1, v.Folder)
+		}
+		filters[k] = f
+	}
+	var moves []plannedMove
+	for _, v := range ls {
+		for k, f := range filters {
+			if f.match(fldr, v) {
+				moves = append(moves, plannedMove{name: v, folder: path.Clean(filepath.ToSlash(config.SortRules[k].Folder)), rule: k})
+				break
+			}
+		}
+	}
+	return moves, nil
+}
+
+// RulesMenu lists the moves the sort rules would make, so they can be checked before anything is moved.
+// The last entry applies them.
+type RulesMenu struct {
+	*ChoiceMenu
+	moves   []plannedMove
+	applied bool
+}
+
+func (menu *RulesMenu) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_RETURN:
+		if menu.Selected == len(menu.moves) {
+			menu.applied = true
+			return LOOP_EXIT
+		}
+	case sdl.K_d:
+		// Leave an image where it is
+		if menu.Selected < len(menu.moves) {
+			menu.moves = slices.Delete(menu.moves, menu.Selected, menu.Selected+1)
+			return LOOP_REDO
+		}
+	default:
+		return menu.ChoiceMenu.keyHandler(key)
+	}
+	return LOOP_CONT
+}
+
+// previewRules shows the moves the sort rules would make. If they are accepted, the moved images are taken out of the Sort menu.
+func (men *SortMenu) previewRules() int {
+	if len(config.SortRules) == 0 {
+		if _, quit := displayMessage("There are no sort rules.\nAdd SortRules to\nImgSort.cfg first."); quit {
+			return LOOP_QUIT
+		}
+		return LOOP_CONT
+	}
+	texture, rect := drawMessage("Checking rules...")
+	display.SetDrawColor(64, 64, 64, 0)
+	display.Clear()
+	display.Copy(texture, nil, rect)
+	display.Present()
+	texture.Destroy()
+	moves, err := planAutoSort(men.fldr, men.itemList)
+	if err != nil {
+		if _, quit := displayMessage(wordWrapper(err.Error(), []string{"Bad sort rule:"})); quit {
+			return LOOP_QUIT
+		}
+		return LOOP_CONT
+	}
+	if len(moves) == 0 {
+		if _, quit := displayMessage("No images match\nthe sort rules."); quit {
+			return LOOP_QUIT
+		}
+		return LOOP_CONT
+	}
+	sel := 0
+	var menu *RulesMenu
+	for {
+		ls := make([]string, 0, len(moves)+1)
+		for _, v := range moves {
+			ls = append(ls, fmt.Sprintf("%s -> %s  (rule %d)", v.name, v.folder, v.rule+1))
+		}
+		ls = append(ls, fmt.Sprintf("Move %d images", len(moves)))
+		if sel >= len(ls) {
+			sel = len(ls) - 1
+		}
+		menu = &RulesMenu{ChoiceMenu: makeMenu(ls, sel), moves: moves}
+		action := stdEventLoop(menu)
+		menu.destroy()
+		if action == LOOP_QUIT {
+			return LOOP_QUIT
+		} else if action != LOOP_REDO {
+			break
+		}
+		sel = menu.Selected
+		moves = menu.moves
+	}
+	if !menu.applied || len(menu.moves) == 0 {
+		return LOOP_CONT
+	}
+	men.stopAnim()
+	moved := make(map[string]bool, len(menu.moves))
+	var errs []error
+	for _, v := range menu.moves {
+		err := os.MkdirAll(filepath.FromSlash(v.folder), 0700)
+		if err == nil {
+			_, err = moveImage(filepath.Join(men.fldr, v.name), v.folder)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		moved[v.name] = true
+	}
+	gone := func(name string) bool { return moved[name] }
+	men.itemList = slices.DeleteFunc(men.itemList, gone)
+	if men.allItems != nil {
+		men.allItems = slices.DeleteFunc(men.allItems, gone)
+	}
+	if men.Selected >= len(men.itemList) {
+		men.Selected = max(len(men.itemList)-1, 0)
+	}
+	men.setNotice(fmt.Sprintf("Moved %d images", len(moved)))
+	if len(errs) != 0 {
+		_, quit := displayMessage(wordWrapper(errors.Join(errs...).Error(), []string{fmt.Sprintf("%d images could not be moved:", len(errs))}))
+		if quit {
+			return LOOP_QUIT
+		}
+	}
+	return men.imageLoader()
+}
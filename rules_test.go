@@ -0,0 +1,86 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanAutoSortFolders(t *testing.T) {
+	oldRules, oldSort := config.SortRules, config.SortFolder
+	defer func() { config.SortRules, config.SortFolder = oldRules, oldSort }()
+	config.SortFolder = "Inbox/Sort"
+	tests := []struct {
+		folder string
+		ok     bool
+	}{
+		{"Cats", true},
+		{"Animals/Cats/", true},
+		{"Inbox", true},
+		{"Inbox/Sorted", true},
+		{"Cats/../Dogs", true},
+		{"", false},
+		{".", false},
+		{"Cats/..", false},
+		{"Inbox/Sort", false},
+		{"Inbox/Sort/Cats", false},
+		{"..", false},
+		{"../Cats", false},
+		{"Cats/../../Dogs", false},
+		{"/Cats", false},
+	}
+	for _, tt := range tests {
+		config.SortRules = []SortRule{{Filter: "cat", Folder: tt.folder}}
+		_, err := planAutoSort("", []string{"cat.jpg"})
+		if tt.ok && err != nil {
+			t.Errorf("%q: %s", tt.folder, err.Error())
+		} else if !tt.ok && err == nil {
+			t.Errorf("%q: no error", tt.folder)
+		}
+	}
+}
+
+func TestPlanAutoSort(t *testing.T) {
+	oldRules, oldSort := config.SortRules, config.SortFolder
+	defer func() { config.SortRules, config.SortFolder = oldRules, oldSort }()
+	config.SortFolder = "Sort"
+	config.SortRules = []SortRule{
+		{Filter: "cat", Folder: "Cats"},
+		{Filter: "ext:png", Folder: "Screenshots/"},
+		{Filter: "kitten", Folder: "Kittens"},
+	}
+	moves, err := planAutoSort("", []string{"cat.png", "dog.png", "kitten.jpg", "bird.jpg", "kitten cat.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first rule that matches wins
+	expected := []plannedMove{
+		{name: "cat.png", folder: "Cats", rule: 0},
+		{name: "dog.png", folder: "Screenshots", rule: 1},
+		{name: "kitten.jpg", folder: "Kittens", rule: 2},
+		{name: "kitten cat.jpg", folder: "Cats", rule: 0},
+	}
+	if !reflect.DeepEqual(moves, expected) {
+		t.Errorf("got %+v, expected %+v", moves, expected)
+	}
+	config.SortRules = append(config.SortRules, SortRule{Filter: "w>", Folder: "Wide"})
+	if _, err = planAutoSort("", nil); err == nil {
+		t.Error("bad filter was accepted")
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/jlortiz0/ImageSort/cache"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Only this many matches are shown
+const maxSimilar = 100
+
+// SimilarMenu browses the images in the library that look like one image, closest first.
+// Only images that have already been hashed are searched.
+type SimilarMenu struct {
+	ImageMenu
+	dists map[string]int
+}
+
+// findSimilar lists hashed images within twice the dupe sensitivity of the image at p, leaving out Trash.
+// p is a slash-separated path relative to the library root. If hsh is nil, the image is hashed.
+func findSimilar(p string, hsh []byte) (*SimilarMenu, bool) {
+	if hsh == nil {
+		var err error
+		hsh, err = getHash(p)
+		if err != nil {
+			_, quit := displayMessage(wordWrapper(err.Error(), []string{"Could not hash " + path.Base(p) + ":"}))
+			return nil, quit
+		}
+	}
+	maxDist := int(config.HashDiff) * 2
+	dists := make(map[string]int)
+	hashes.Range(func(k string, e cache.Entry) {
+		if k == p || inFolder(k, config.TrashFolder) {
+			return
+		}
+		if d := hashDistance(hsh, e.Hash); d <= maxDist && len(e.Hash) == len(hsh) {
+			dists[k] = d
+		}
+	})
+	ls := make([]string, 0, len(dists))
+	for k := range dists {
+		// The cache can have entries for files that are gone
+		if _, err := os.Stat(k); err == nil {
+			ls = append(ls, k)
+		}
+	}
+	if len(ls) == 0 {
+		_, quit := displayMessage("No similar images found.\nOnly images that have been\nhashed are searched.")
+		return nil, quit
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		if dists[ls[i]] != dists[ls[j]] {
+			return dists[ls[i]] < dists[ls[j]]
+		}
+		return ls[i] < ls[j]
+	})
+	if len(ls) > maxSimilar {
+		ls = ls[:maxSimilar]
+	}
+	menu := &SimilarMenu{dists: dists}
+	menu.fldr = "."
+	menu.itemList = ls
+	menu.sortMode = config.SortMode
+	display.SetDrawColor(64, 64, 64, 0)
+	return menu, false
+}
+
+// browseSimilar opens a SimilarMenu for the image at p, which has the hash hsh if it isn't nil.
+func browseSimilar(p string, hsh []byte) int {
+	menu, quit := findSimilar(p, hsh)
+	if quit {
+		return LOOP_QUIT
+	}
+	if menu == nil {
+		return LOOP_CONT
+	}
+	menu.imageLoader()
+	if stdEventLoop(menu) == LOOP_QUIT {
+		return LOOP_QUIT
+	}
+	menu.destroy()
+	return LOOP_CONT
+}
+
+func (menu *SimilarMenu) keyHandler(key sdl.Keycode) int {
+	switch key {
+	case sdl.K_o:
+		// Keep the matches in order of distance
+	case sdl.K_RETURN:
+		return openInFolder(&menu.ImageMenu)
+	default:
+		return menu.ImageMenu.keyHandler(key)
+	}
+	return LOOP_CONT
+}
+
+// openInFolder opens the folder of menu's current image, which is a path relative to the library root, with that image selected.
+func openInFolder(menu *ImageMenu) int {
+	cur := menu.itemList[menu.Selected]
+	imgMenu, quit := makeImageMenu(path.Dir(cur), false)
+	if quit {
+		return LOOP_QUIT
+	}
+	if imgMenu != nil {
+		for k, v := range imgMenu.itemList {
+			if v == path.Base(cur) {
+				imgMenu.Selected = k
+				break
+			}
+		}
+		imgMenu.imageLoader()
+		if stdEventLoop(imgMenu) == LOOP_QUIT {
+			return LOOP_QUIT
+		}
+		imgMenu.destroy()
+	}
+	// The image may have been moved while its folder was open
+	ret := menu.imageLoader()
+	if ret != LOOP_CONT {
+		return ret
+	}
+	saveScreen()
+	display.SetDrawColor(64, 64, 64, 0)
+	menu.renderer()
+	fadeScreen()
+	return LOOP_CONT
+}
+
+func (menu *SimilarMenu) renderer() {
+	menu.ImageMenu.renderer()
+	if len(menu.itemList) == 0 || menu.tagging {
+		return
+	}
+	cur := menu.itemList[menu.Selected]
+	surf, err := font.RenderUTF8Shaded(fmt.Sprintf("%s  (distance %d)", cur, menu.dists[cur]), COLOR_BLACK, COLOR_WHITE)
+	if err != nil {
+		panic(err)
+	}
+	txt, _ := display.CreateTextureFromSurface(surf)
+	display.Copy(txt, nil, &sdl.Rect{H: surf.H, W: surf.W})
+	surf.Free()
+	txt.Destroy()
+}
+
+// The matches are only found once, so a SimilarMenu doesn't refresh
+func (menu *SimilarMenu) refresh() int {
+	return LOOP_CONT
+}
@@ -0,0 +1,251 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jlortiz0/multisav/streamy"
+)
+
+const (
+	SORT_NAME = iota
+	SORT_SIZE
+	SORT_TAKEN
+	SORT_MODIFIED
+	SORT_PIXELS
+	SORT_ASPECT
+	SORT_SIMILAR
+	SORT_NATURAL
+)
+
+var sortModeNames = []string{"Name", "Size", "Date Taken", "Modified", "Pixel Count", "Aspect Ratio", "Similarity", "Natural"}
+
+func isAnimated(name string) bool {
+	switch strings.ToLower(name[strings.LastIndexByte(name, '.')+1:]) {
+	case "mp4":
+		fallthrough
+	case "webm":
+		fallthrough
+	case "gif":
+		fallthrough
+	case "mov":
+		return true
+	}
+	return false
+}
+
+// imageDimensions gets the size of an image or video without decoding all of it.
+// imaging registers the decoders we need for image.DecodeConfig.
+func imageDimensions(p string) (int32, int32, error) {
+	if isAnimated(p) && !strings.EqualFold(filepath.Ext(p), ".gif") {
+		rd, err := streamy.NewAvVideoReader(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		w, h := rd.GetDimensions()
+		rd.Destroy()
+		return w, h, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int32(cfg.Width), int32(cfg.Height), nil
+}
+
+// sortImages sorts a list of files in fldr according to mode.
+// Size and pixel count are largest first, everything else is smallest or oldest first.
+func sortImages(fldr string, ls []string, mode uint16, reverse bool) {
+	switch mode {
+	case SORT_SIZE:
+		srtMap := make(map[string]int64, len(ls))
+		for _, v := range ls {
+			info, err := os.Stat(filepath.Join(fldr, v))
+			if err == nil {
+				srtMap[v] = info.Size()
+			}
+		}
+		sort.SliceStable(ls, func(i, j int) bool { return srtMap[ls[i]] > srtMap[ls[j]] })
+	case SORT_TAKEN:
+		srtMap := make(map[string]time.Time, len(ls))
+		for _, v := range ls {
+			srtMap[v] = dateTaken(filepath.Join(fldr, v))
+		}
+		sort.SliceStable(ls, func(i, j int) bool { return srtMap[ls[i]].Before(srtMap[ls[j]]) })
+	case SORT_MODIFIED:
+		srtMap := make(map[string]int64, len(ls))
+		for _, v := range ls {
+			info, err := os.Stat(filepath.Join(fldr, v))
+			if err == nil {
+				srtMap[v] = info.ModTime().UnixNano()
+			}
+		}
+		sort.SliceStable(ls, func(i, j int) bool { return srtMap[ls[i]] < srtMap[ls[j]] })
+	case SORT_PIXELS:
+		srtMap := make(map[string]int64, len(ls))
+		for _, v := range ls {
+			w, h, err := imageDimensions(filepath.Join(fldr, v))
+			if err == nil {
+				srtMap[v] = int64(w) * int64(h)
+			}
+		}
+		sort.SliceStable(ls, func(i, j int) bool { return srtMap[ls[i]] > srtMap[ls[j]] })
+	case SORT_ASPECT:
+		srtMap := make(map[string]float64, len(ls))
+		for _, v := range ls {
+			w, h, err := imageDimensions(filepath.Join(fldr, v))
+			if err == nil && h != 0 {
+				srtMap[v] = float64(w) / float64(h)
+			}
+		}
+		sort.SliceStable(ls, func(i, j int) bool { return srtMap[ls[i]] < srtMap[ls[j]] })
+	case SORT_SIMILAR:
+		sort.Strings(ls)
+		sortBySimilarity(fldr, ls)
+	case SORT_NATURAL:
+		sortNatural(ls)
+	default:
+		sort.Strings(ls)
+	}
+	if reverse {
+		slices.Reverse(ls)
+	}
+}
+
+// sortBySimilarity orders ls so that each image is followed by the remaining image closest to it.
+// It's greedy, but it's good enough to put similar images next to each other.
+// Images that fail to hash are put at the end.
+func sortBySimilarity(fldr string, ls []string) {
+	texture, rect := drawMessage("Sorting by similarity...\nPreparing...")
+	display.Clear()
+	display.Copy(texture, nil, rect)
+	display.Present()
+	lastUpdate := time.Now()
+	hashLs := make([][]byte, 0, len(ls))
+	hashed := make([]string, 0, len(ls))
+	failed := make([]string, 0)
+	for i, v := range ls {
+		noteActivity()
+		hsh, err := getHash(path.Join(filepath.ToSlash(fldr), v))
+		if err != nil {
+			failed = append(failed, v)
+		} else {
+			hashLs = append(hashLs, hsh)
+			hashed = append(hashed, v)
+		}
+		if time.Since(lastUpdate) > time.Second/4 {
+			texture.Destroy()
+			texture, rect = drawMessage(fmt.Sprintf("Sorting by similarity...\nHashing %.1f%%", float32(i)/float32(len(ls))*100))
+			display.Clear()
+			display.Copy(texture, nil, rect)
+			display.Present()
+			lastUpdate = time.Now()
+		}
+	}
+	texture.Destroy()
+	ls = ls[:0]
+	for len(hashed) > 0 {
+		ls = append(ls, hashed[0])
+		hsh := hashLs[0]
+		hashed[0] = hashed[len(hashed)-1]
+		hashLs[0] = hashLs[len(hashLs)-1]
+		hashed = hashed[:len(hashed)-1]
+		hashLs = hashLs[:len(hashLs)-1]
+		best := -1
+		bestDist := -1
+		for k, v := range hashLs {
+			dist := hashDistance(hsh, v)
+			if best == -1 || dist < bestDist {
+				best = k
+				bestDist = dist
+			}
+		}
+		if best > 0 {
+			hashed[0], hashed[best] = hashed[best], hashed[0]
+			hashLs[0], hashLs[best] = hashLs[best], hashLs[0]
+		}
+	}
+	ls = append(ls, failed...)
+}
+
+func sortNatural(ls []string) {
+	fold := config.IgnoreCase != 0
+	sort.Slice(ls, func(i, j int) bool { return naturalLess(ls[i], ls[j], fold) })
+}
+
+// naturalLess compares two names with runs of digits compared by value, so img2 comes before img10.
+// If the names are otherwise equal, it falls back to comparing bytes so the order is stable.
+func naturalLess(a, b string, fold bool) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			da := strings.TrimLeft(a[si:i], "0")
+			db := strings.TrimLeft(b[sj:j], "0")
+			// No leading zeros, so a longer run is a bigger number
+			if len(da) != len(db) {
+				return len(da) < len(db)
+			}
+			if da != db {
+				return da < db
+			}
+			continue
+		}
+		ra, wa := utf8.DecodeRuneInString(a[i:])
+		rb, wb := utf8.DecodeRuneInString(b[j:])
+		if fold {
+			ra = unicode.ToLower(ra)
+			rb = unicode.ToLower(rb)
+		}
+		if ra != rb {
+			return ra < rb
+		}
+		i += wa
+		j += wb
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,51 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "testing"
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		fold bool
+		less bool
+	}{
+		{"img2.jpg", "img10.jpg", false, true},
+		{"img10.jpg", "img2.jpg", false, false},
+		{"img2.jpg", "img2.jpg", false, false},
+		{"a", "ab", false, true},
+		{"ab", "a", false, false},
+		// Leading zeros don't change the number, but still give a fixed order
+		{"img02.jpg", "img2.jpg", false, true},
+		{"img2.jpg", "img02.jpg", false, false},
+		{"img002.jpg", "img10.jpg", false, true},
+		{"x9y10", "x9y9", false, false},
+		{"x9y9", "x10y1", false, true},
+		{"12345678901234567890", "12345678901234567891", false, true},
+		{"B.jpg", "a.jpg", false, true},
+		{"B.jpg", "a.jpg", true, false},
+		{"a.jpg", "B.jpg", true, true},
+		{"É1", "é2", true, true},
+		{"1.jpg", "a.jpg", false, true},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b, tt.fold); got != tt.less {
+			t.Errorf("naturalLess(%q, %q, %v) = %v, expected %v", tt.a, tt.b, tt.fold, got, tt.less)
+		}
+	}
+}
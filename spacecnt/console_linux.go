@@ -1,3 +0,0 @@
-package main
-
-func shouldPause() bool { return false }
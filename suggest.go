@@ -0,0 +1,95 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"path"
+	"sort"
+
+	"github.com/jlortiz0/ImageSort/cache"
+)
+
+const (
+	// At most this many folders are suggested
+	maxSuggestions = 3
+	// A folder's score is the average distance to this many of its closest images
+	suggestNearest = 3
+)
+
+// folderHashes collects the cached hashes of the images directly in each of folders.
+// Only images that have already been hashed are used, so suggestions get better as the library is hashed.
+func folderHashes(folders []string) map[string][][]byte {
+	out := make(map[string][][]byte, len(folders))
+	for _, v := range folders {
+		out[v] = nil
+	}
+	hashes.Range(func(k string, e cache.Entry) {
+		if ls, ok := out[path.Dir(k)]; ok {
+			out[path.Dir(k)] = append(ls, e.Hash)
+		}
+	})
+	return out
+}
+
+// suggestFolders ranks the folders by how much their images look like an image with the hash hsh, best first.
+// Folders with nothing within twice the dupe sensitivity aren't suggested.
+func suggestFolders(hsh []byte, known map[string][][]byte) []string {
+	maxDist := int(config.HashDiff) * 2
+	scores := make(map[string]float64)
+	nearest := make([]int, 0, suggestNearest)
+	for folder, ls := range known {
+		nearest = nearest[:0]
+		for _, v := range ls {
+			if len(v) != len(hsh) {
+				continue
+			}
+			d := hashDistance(hsh, v)
+			if len(nearest) < suggestNearest {
+				nearest = append(nearest, d)
+				sort.Ints(nearest)
+			} else if d < nearest[suggestNearest-1] {
+				nearest[suggestNearest-1] = d
+				sort.Ints(nearest)
+			}
+		}
+		if len(nearest) == 0 || nearest[0] > maxDist {
+			continue
+		}
+		total := 0
+		for _, d := range nearest {
+			total += d
+		}
+		// Folders with fewer images than suggestNearest count the missing ones as far away
+		total += (suggestNearest - len(nearest)) * maxDist
+		scores[folder] = float64(total) / suggestNearest
+	}
+	out := make([]string, 0, len(scores))
+	for k := range scores {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if scores[out[i]] != scores[out[j]] {
+			return scores[out[i]] < scores[out[j]]
+		}
+		return out[i] < out[j]
+	})
+	if len(out) > maxSuggestions {
+		out = out[:maxSuggestions]
+	}
+	return out
+}
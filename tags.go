@@ -0,0 +1,407 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// TagStore keeps the tags of each image, so an image can be in more than one category without being copied.
+// Like the hash cache, it is keyed by slash-separated paths relative to the library root.
+type TagStore struct {
+	tags  map[string][]string
+	dirty bool
+}
+
+// Use path for keys to tags, not filepath
+var tags = &TagStore{tags: make(map[string][]string)}
+
+func loadTags() error {
+	tags = &TagStore{tags: make(map[string][]string)}
+	data, err := os.ReadFile(library.tagsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &tags.tags)
+}
+
+// saveTags writes the tags if they have changed since they were loaded.
+func saveTags() error {
+	if !tags.dirty {
+		return nil
+	}
+	b, err := json.Marshal(tags.tags)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(library.tagsPath, b, 0644)
+	if err == nil {
+		tags.dirty = false
+	}
+	return err
+}
+
+// Get returns the tags of the image at p, sorted by name.
+func (ts *TagStore) Get(p string) []string {
+	return ts.tags[p]
+}
+
+// Toggle adds tag to the image at p, or removes it if the image already has it. It returns whether the image has the tag now.
+func (ts *TagStore) Toggle(p, tag string) bool {
+	ls := ts.tags[p]
+	ts.dirty = true
+	i, found := slices.BinarySearch(ls, tag)
+	if !found {
+		ts.tags[p] = slices.Insert(ls, i, tag)
+		return true
+	}
+	ls = slices.Delete(ls, i, i+1)
+	if len(ls) == 0 {
+		delete(ts.tags, p)
+	} else {
+		ts.tags[p] = ls
+	}
+	return false
+}
+
+// Set replaces the tags of the image at p.
+func (ts *TagStore) Set(p string, ls []string) {
+	ls = slices.Clone(ls)
+	slices.Sort(ls)
+	ls = slices.Compact(ls)
+	if slices.Equal(ls, ts.tags[p]) {
+		return
+	}
+	if len(ls) == 0 {
+		delete(ts.tags, p)
+	} else {
+		ts.tags[p] = ls
+	}
+	ts.dirty = true
+}
+
+// Move moves the tags of from to to, replacing any tags to had.
+func (ts *TagStore) Move(from, to string) {
+	ls, ok := ts.tags[from]
+	if !ok || from == to {
+		return
+	}
+	delete(ts.tags, from)
+	ts.tags[to] = ls
+	ts.dirty = true
+}
+
+// Copy gives to the same tags as from.
+func (ts *TagStore) Copy(from, to string) {
+	ls, ok := ts.tags[from]
+	if !ok || from == to {
+		return
+	}
+	ts.tags[to] = slices.Clone(ls)
+	ts.dirty = true
+}
+
+// Swap swaps the tags of two paths.
+func (ts *TagStore) Swap(a, b string) {
+	la, okA := ts.tags[a]
+	lb, okB := ts.tags[b]
+	if !okA && !okB {
+		return
+	}
+	delete(ts.tags, a)
+	delete(ts.tags, b)
+	if okA {
+		ts.tags[b] = la
+	}
+	if okB {
+		ts.tags[a] = lb
+	}
+	ts.dirty = true
+}
+
+// DeleteIf removes the tags of every path that f returns true for.
+func (ts *TagStore) DeleteIf(f func(string) bool) {
+	for k := range ts.tags {
+		if f(k) {
+			delete(ts.tags, k)
+			ts.dirty = true
+		}
+	}
+}
+
+// Counts returns how many images have each tag.
+func (ts *TagStore) Counts() map[string]int {
+	out := make(map[string]int)
+	for _, ls := range ts.tags {
+		for _, v := range ls {
+			out[v]++
+		}
+	}
+	return out
+}
+
+// Names lists every tag in use, sorted by name.
+func (ts *TagStore) Names() []string {
+	counts := ts.Counts()
+	out := make([]string, 0, len(counts))
+	for k := range counts {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// With lists the images that have tag.
+func (ts *TagStore) With(tag string) []string {
+	var out []string
+	for k, ls := range ts.tags {
+		if _, found := slices.BinarySearch(ls, tag); found {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// cleanTag makes typed text into a tag, or returns an empty string if there is nothing left.
+// Case is kept, since other programs may share the tags through XMP.
+func cleanTag(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// makeTagBar makes a bar of tags instead of folders. Tags are always in order of name.
+func makeTagBar() *FolderBar {
+	bar := &FolderBar{folders: tags.Names(), keys: folderKeys(), show: true, tags: true}
+	bar.layout()
+	return bar
+}
+
+// addTag puts a new tag on the bar, if it isn't already there.
+func (bar *FolderBar) addTag(tag string) {
+	i, found := slices.BinarySearch(bar.folders, tag)
+	if found {
+		return
+	}
+	bar.folders = slices.Insert(bar.folders, i, tag)
+	bar.layout()
+}
+
+// tagPath is the key for the current image's tags.
+func (menu *ImageMenu) tagPath() string {
+	return path.Join(menu.fldr, filepath.ToSlash(menu.itemList[menu.Selected]))
+}
+
+// toggleTag adds or removes tag on the current image, and puts the tag on the tag bar if it is new.
+// The image's XMP is updated if the XMP option is on.
+func (menu *ImageMenu) toggleTag(tag string) int {
+	if len(menu.itemList) == 0 {
+		return LOOP_CONT
+	}
+	p := menu.tagPath()
+	if tags.Toggle(p, tag) {
+		menu.setNotice("Tagged " + tag)
+	} else {
+		menu.setNotice("Untagged " + tag)
+	}
+	if menu.tagBar != nil {
+		menu.tagBar.addTag(tag)
+		menu.tagFor = ""
+	}
+	if err := syncXmp(p); err != nil {
+		if _, quit := displayMessage(wordWrapper(err.Error(), []string{"Could not write XMP:"})); quit {
+			return LOOP_QUIT
+		}
+	}
+	return LOOP_CONT
+}
+
+// tagKeys handles T, Shift + T, and the tag bar's keys while tagging. It returns false if key isn't one of them.
+func (menu *ImageMenu) tagKeys(key sdl.Keycode) (int, bool) {
+	if key == sdl.K_t && sdl.GetModState()&sdl.KMOD_SHIFT != 0 {
+		if len(menu.itemList) == 0 {
+			return LOOP_CONT, true
+		}
+		tag := searchFolders(tags.Names(), true)
+		if tag == "\x00" {
+			return LOOP_QUIT, true
+		} else if tag != "" {
+			return menu.toggleTag(tag), true
+		}
+		return LOOP_CONT, true
+	} else if key == sdl.K_t {
+		menu.tagging = !menu.tagging
+		if menu.tagging && menu.tagBar == nil {
+			menu.tagBar = makeTagBar()
+		}
+		menu.tagFor = ""
+		return LOOP_CONT, true
+	}
+	if !menu.tagging {
+		return LOOP_CONT, false
+	}
+	tag, ret, ok := menu.tagBar.keyHandler(key)
+	if tag != "" {
+		return menu.toggleTag(tag), true
+	}
+	return ret, ok
+}
+
+// renderTagBar draws the tag bar, highlighting the current image's tags.
+func (menu *ImageMenu) renderTagBar() {
+	if len(menu.itemList) == 0 {
+		return
+	}
+	p := menu.tagPath()
+	if len(menu.tagBar.folders) == 0 {
+		surf, err := font.RenderUTF8Shaded("No tags yet. Shift + T - Add a tag", COLOR_BLACK, COLOR_WHITE)
+		if err != nil {
+			panic(err)
+		}
+		txt, _ := display.CreateTextureFromSurface(surf)
+		display.Copy(txt, nil, &sdl.Rect{H: surf.H, W: surf.W})
+		surf.Free()
+		txt.Destroy()
+		return
+	}
+	if menu.tagFor != p || menu.tagBar.texture == nil {
+		menu.tagBar.marked = tags.Get(p)
+		menu.tagBar.load(-1)
+		menu.tagFor = p
+	}
+	menu.tagBar.renderer()
+}
+
+// TagMenu browses every image with one tag, wherever it is in the library.
+type TagMenu struct {
+	ImageMenu
+	tag string
+}
+
+// makeTagMenu lists the images with tag, leaving out Trash and files that are gone.
+func makeTagMenu(tag string) (*TagMenu, bool) {
+	var ls []string
+	for _, v := range tags.With(tag) {
+		if inFolder(v, config.TrashFolder) {
+			continue
+		}
+		if _, err := os.Stat(v); err == nil {
+			ls = append(ls, v)
+		}
+	}
+	if len(ls) == 0 {
+		_, quit := displayMessage("No images are tagged\n" + tag + ".")
+		return nil, quit
+	}
+	sortImages(".", ls, config.SortMode, config.ReverseSort != 0)
+	menu := &TagMenu{tag: tag}
+	menu.fldr = "."
+	menu.itemList = ls
+	menu.sortMode = config.SortMode
+	menu.reverseSort = config.ReverseSort != 0
+	display.SetDrawColor(64, 64, 64, 0)
+	return menu, false
+}
+
+// TagListMenu picks a tag to browse.
+type TagListMenu struct {
+	*ChoiceMenu
+	chosen bool
+}
+
+func (menu *TagListMenu) keyHandler(key sdl.Keycode) int {
+	if key == sdl.K_RETURN {
+		menu.chosen = true
+		return LOOP_EXIT
+	}
+	return menu.ChoiceMenu.keyHandler(key)
+}
+
+// browseTags asks for a tag, then browses the images with it.
+func browseTags() int {
+	counts := tags.Counts()
+	names := tags.Names()
+	if len(names) == 0 {
+		if _, quit := displayMessage("There are no tags yet.\nPress Shift + T in the\nimage browser to add one."); quit {
+			return LOOP_QUIT
+		}
+		return LOOP_CONT
+	}
+	ls := make([]string, len(names))
+	for k, v := range names {
+		ls[k] = fmt.Sprintf("%s (%d)", v, counts[v])
+	}
+	choice := &TagListMenu{ChoiceMenu: makeMenu(ls, 0)}
+	action := stdEventLoop(choice)
+	choice.destroy()
+	if action == LOOP_QUIT {
+		return LOOP_QUIT
+	} else if !choice.chosen {
+		return LOOP_CONT
+	}
+	menu, quit := makeTagMenu(names[choice.Selected])
+	if quit {
+		return LOOP_QUIT
+	}
+	if menu == nil {
+		return LOOP_CONT
+	}
+	menu.imageLoader()
+	if stdEventLoop(menu) == LOOP_QUIT {
+		return LOOP_QUIT
+	}
+	menu.destroy()
+	return LOOP_CONT
+}
+
+func (menu *TagMenu) keyHandler(key sdl.Keycode) int {
+	if key == sdl.K_RETURN && !menu.tagging {
+		return openInFolder(&menu.ImageMenu)
+	}
+	return menu.ImageMenu.keyHandler(key)
+}
+
+func (menu *TagMenu) renderer() {
+	menu.ImageMenu.renderer()
+	if len(menu.itemList) == 0 || menu.tagging {
+		return
+	}
+	surf, err := font.RenderUTF8Shaded(fmt.Sprintf("%s  (tagged %s)", menu.itemList[menu.Selected], menu.tag), COLOR_BLACK, COLOR_WHITE)
+	if err != nil {
+		panic(err)
+	}
+	txt, _ := display.CreateTextureFromSurface(surf)
+	display.Copy(txt, nil, &sdl.Rect{H: surf.H, W: surf.W})
+	surf.Free()
+	txt.Destroy()
+}
+
+// The images are only found once, so a TagMenu doesn't refresh
+func (menu *TagMenu) refresh() int {
+	return LOOP_CONT
+}
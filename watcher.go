@@ -0,0 +1,186 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jlortiz0/ImageSort/cache"
+)
+
+// Wait this long after the last change before refreshing, so a big copy doesn't refresh on every file
+const watchSettle = 300 * time.Millisecond
+
+// The watcher notices files being added or removed by something other than ImageSort.
+// Changes are collected by path until the menu showing that folder takes them.
+// If it can't be started, menus just don't refresh.
+var watcher struct {
+	w       *fsnotify.Watcher
+	lock    sync.Mutex
+	refs    map[string]int
+	changes map[string]fsnotify.Op
+	last    time.Time
+}
+
+// Refresher is a menu that updates itself when the folders it shows change.
+type Refresher interface {
+	refresh() int
+}
+
+func initWatcher() {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	watcher.w = w
+	watcher.refs = make(map[string]int)
+	watcher.changes = make(map[string]fsnotify.Op)
+	go func() {
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				watcher.lock.Lock()
+				p := filepath.ToSlash(ev.Name)
+				watcher.changes[p] |= ev.Op
+				watcher.last = time.Now()
+				watcher.lock.Unlock()
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func closeWatcher() {
+	if watcher.w != nil {
+		watcher.w.Close()
+	}
+}
+
+// watchFolder starts watching dir, and its subfolders if recursive is set.
+// It returns the folders being watched, which should be passed to unwatchFolders when done.
+func watchFolder(dir string, recursive bool) []string {
+	if watcher.w == nil {
+		return nil
+	}
+	dirs := []string{dir}
+	if recursive {
+		filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() && p != dir {
+				if d.Name()[0] == '.' || d.Name()[0] == '$' {
+					return fs.SkipDir
+				}
+				dirs = append(dirs, filepath.ToSlash(p))
+			}
+			return nil
+		})
+	}
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+	for _, v := range dirs {
+		if watcher.refs[v] == 0 {
+			watcher.w.Add(filepath.FromSlash(v))
+		}
+		watcher.refs[v]++
+	}
+	return dirs
+}
+
+func unwatchFolders(dirs []string) {
+	if watcher.w == nil {
+		return
+	}
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+	for _, v := range dirs {
+		watcher.refs[v]--
+		if watcher.refs[v] > 0 {
+			continue
+		}
+		delete(watcher.refs, v)
+		watcher.w.Remove(filepath.FromSlash(v))
+		for k := range watcher.changes {
+			if path.Dir(k) == v {
+				delete(watcher.changes, k)
+			}
+		}
+	}
+}
+
+// takeChanges returns and forgets the changes to entries of dir, or anywhere under it if recursive is set.
+// Nothing is returned until the folder has settled.
+func takeChanges(dir string, recursive bool) map[string]fsnotify.Op {
+	if watcher.w == nil {
+		return nil
+	}
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+	if len(watcher.changes) == 0 || time.Since(watcher.last) < watchSettle {
+		return nil
+	}
+	var out map[string]fsnotify.Op
+	for k, v := range watcher.changes {
+		if path.Dir(k) == dir || (recursive && (dir == "." || inFolder(k, dir))) {
+			if out == nil {
+				out = make(map[string]fsnotify.Op)
+			}
+			out[k] = v
+			delete(watcher.changes, k)
+		}
+	}
+	return out
+}
+
+// invalidateHashes drops cache entries for files that were written to.
+// Removed and created files keep their entries, so the hash can follow a file that was moved.
+// Entries that still match the file are kept, since ImageSort writes files too, like when copying an image with its hash.
+func invalidateHashes(changes map[string]fsnotify.Op) {
+	for k, v := range changes {
+		if v.Has(fsnotify.Write) && !hashMatches(k) {
+			hashes.Delete(k)
+		}
+	}
+}
+
+// hashMatches is true if the cache entry for p has the file's modification time, size and fingerprint.
+func hashMatches(p string) bool {
+	entry, ok := hashes.Get(p)
+	if !ok || entry.Size == 0 {
+		return false
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.ModTime().Unix() != entry.ModTime || info.Size() != entry.Size {
+		return false
+	}
+	_, fp, err := cache.Fingerprint(p)
+	return err == nil && fp == entry.Fingerprint
+}
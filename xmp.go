@@ -0,0 +1,582 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jlortiz0/ImageSort/cache"
+)
+
+const (
+	XMP_OFF = iota
+	XMP_SIDECAR
+	XMP_EMBED
+)
+
+var xmpModeNames = []string{"Off", "Sidecars", "Embed in JPEGs"}
+
+const (
+	XMP_NS_RDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	XMP_NS_DC  = "http://purl.org/dc/elements/1.1/"
+	XMP_NS_XMP = "http://ns.adobe.com/xap/1.0/"
+)
+
+// The header of the APP1 segment that holds XMP in a JPEG
+var jpegXmpHeader = []byte(XMP_NS_XMP + "\x00")
+
+// The most XMP that fits in one JPEG segment
+const maxJpegXmp = 0xFFFF - 2 - 29
+
+var errNoXmp = errors.New("no xmp data")
+
+// The packet written when an image doesn't have any XMP yet
+const emptyXmp = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="">
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+// xmpMeta is the part of an XMP packet that ImageSort reads and writes.
+// hasTags and hasRating are false if the packet doesn't say anything about them, so ImageSort's own data is kept.
+type xmpMeta struct {
+	tags      []string
+	hasTags   bool
+	rating    int
+	hasRating bool
+}
+
+// sidecarPath finds the XMP sidecar of the image at p. Both photo.jpg.xmp and photo.xmp are looked for, in that order.
+// If there isn't one, it returns photo.jpg.xmp and false.
+func sidecarPath(p string) (string, bool) {
+	full := sidecarFor(p, true)
+	if _, err := os.Stat(full); err == nil {
+		return full, true
+	}
+	short := sidecarFor(p, false)
+	if _, err := os.Stat(short); err == nil {
+		return short, true
+	}
+	return full, false
+}
+
+func isJpeg(p string) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// readXmpPacket returns the XMP of the image at p, from its sidecar or, for a JPEG without one, from inside the file.
+func readXmpPacket(p string) ([]byte, error) {
+	if side, ok := sidecarPath(p); ok {
+		return os.ReadFile(side)
+	}
+	if isJpeg(p) {
+		packet, err := findJpegXmp(p)
+		return packet, err
+	}
+	return nil, errNoXmp
+}
+
+// parseXmp reads the keywords and rating out of an XMP packet.
+// Keywords are the dc:subject bag, which digiKam, darktable and Lightroom all use. The rating is xmp:Rating, as an attribute or an element.
+func parseXmp(packet []byte) (xmpMeta, error) {
+	var meta xmpMeta
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	var inSubject, inItem, inRating bool
+	var text strings.Builder
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return meta, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			for _, a := range tok.Attr {
+				if a.Name.Space == XMP_NS_XMP && a.Name.Local == "Rating" {
+					meta.setRating(a.Value)
+				}
+			}
+			switch {
+			case tok.Name.Space == XMP_NS_DC && tok.Name.Local == "subject":
+				inSubject = true
+				meta.hasTags = true
+			case inSubject && tok.Name.Space == XMP_NS_RDF && tok.Name.Local == "li":
+				inItem = true
+				text.Reset()
+			case tok.Name.Space == XMP_NS_XMP && tok.Name.Local == "Rating":
+				inRating = true
+				text.Reset()
+			}
+		case xml.CharData:
+			if inItem || inRating {
+				text.Write(tok)
+			}
+		case xml.EndElement:
+			switch {
+			case inItem && tok.Name.Space == XMP_NS_RDF && tok.Name.Local == "li":
+				inItem = false
+				if tag := cleanTag(text.String()); tag != "" {
+					meta.tags = append(meta.tags, tag)
+				}
+			case tok.Name.Space == XMP_NS_DC && tok.Name.Local == "subject":
+				inSubject = false
+			case inRating && tok.Name.Space == XMP_NS_XMP && tok.Name.Local == "Rating":
+				inRating = false
+				meta.setRating(text.String())
+			}
+		}
+	}
+	return meta, nil
+}
+
+func (meta *xmpMeta) setRating(s string) {
+	// Some tools write ratings like 3.0
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err == nil {
+		meta.rating = int(f)
+		meta.hasRating = true
+	}
+}
+
+// readXmp returns what the XMP of the image at p says about its tags and rating.
+func readXmp(p string) (xmpMeta, error) {
+	packet, err := readXmpPacket(p)
+	if err != nil {
+		return xmpMeta{}, err
+	}
+	return parseXmp(packet)
+}
+
+var (
+	xmpDescStart = regexp.MustCompile(`<rdf:Description\b[^>]*?(/?)>`)
+	xmpSubject   = regexp.MustCompile(`(?s)\s*<dc:subject\s*/>|\s*<dc:subject\b.*?</dc:subject>`)
+	xmpRatingEl  = regexp.MustCompile(`(?s)\s*<xmp:Rating\b[^>]*>.*?</xmp:Rating>`)
+	xmpRatingAt  = regexp.MustCompile(`\s+xmp:Rating\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// setXmp changes the keywords and rating in an XMP packet, if meta has them, leaving everything else alone.
+// Other tools keep a lot in their sidecars, like darktable's edit history, so the packet is edited as text instead of being written out again.
+// This expects the usual rdf, dc and xmp prefixes, which every tool we care about uses. An empty packet starts a new one.
+func setXmp(packet []byte, meta xmpMeta) ([]byte, error) {
+	s := string(packet)
+	if strings.TrimSpace(s) == "" {
+		s = emptyXmp
+	}
+	loc := xmpDescStart.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil, errors.New("xmp has no rdf:Description")
+	}
+	if meta.hasTags {
+		s = xmpSubject.ReplaceAllString(s, "")
+	}
+	if meta.hasRating {
+		s = xmpRatingEl.ReplaceAllString(s, "")
+		s = xmpRatingAt.ReplaceAllString(s, "")
+	}
+	// Removing things before the description could have moved it
+	loc = xmpDescStart.FindStringSubmatchIndex(s)
+	start := s[loc[0]:loc[1]]
+	selfClosing := loc[3] > loc[2]
+	attrs := strings.TrimSuffix(strings.TrimSuffix(start, ">"), "/")
+	if meta.hasTags && len(meta.tags) != 0 && !strings.Contains(attrs, `xmlns:dc="`+XMP_NS_DC+`"`) {
+		attrs += "\n    xmlns:dc=\"" + XMP_NS_DC + "\""
+	}
+	if meta.hasRating && !strings.Contains(attrs, `xmlns:xmp="`+XMP_NS_XMP+`"`) {
+		attrs += "\n    xmlns:xmp=\"" + XMP_NS_XMP + "\""
+	}
+	if meta.hasRating {
+		attrs += "\n    xmp:Rating=\"" + strconv.Itoa(meta.rating) + "\""
+	}
+	var body strings.Builder
+	body.WriteString(attrs)
+	body.WriteString(">")
+	if meta.hasTags && len(meta.tags) != 0 {
+		body.WriteString("\n   <dc:subject>\n    <rdf:Bag>\n")
+		for _, v := range meta.tags {
+			body.WriteString("     <rdf:li>")
+			xml.EscapeText(&body, []byte(v))
+			body.WriteString("</rdf:li>\n")
+		}
+		body.WriteString("    </rdf:Bag>\n   </dc:subject>")
+	}
+	if selfClosing {
+		body.WriteString("\n  </rdf:Description>")
+	}
+	return []byte(s[:loc[0]] + body.String() + s[loc[1]:]), nil
+}
+
+var errBadJpeg = errors.New("jpeg is corrupt")
+
+// jpegHasLength is false for the markers that stand on their own, without a length or any data.
+func jpegHasLength(marker byte) bool {
+	return marker != 0x01 && (marker < 0xD0 || marker > 0xD7)
+}
+
+// nextJpegSegment reads up to the data of the next segment of a JPEG, skipping fill bytes and markers without data.
+// It returns the segment's marker and how long its data is. At the start of the image data, 0xDA is returned and nothing more should be read.
+func nextJpegSegment(reader *bufio.Reader) (byte, int, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	if b != 0xFF {
+		return 0, 0, errBadJpeg
+	}
+	for {
+		marker, err := reader.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		if marker == 0xFF {
+			// Fill byte
+			continue
+		} else if marker == 0xDA || marker == 0xD9 {
+			return marker, 0, nil
+		} else if !jpegHasLength(marker) {
+			b, err = reader.ReadByte()
+			if err != nil {
+				return 0, 0, err
+			}
+			if b != 0xFF {
+				return 0, 0, errBadJpeg
+			}
+			continue
+		}
+		temp := make([]byte, 2)
+		_, err = io.ReadFull(reader, temp)
+		if err != nil {
+			return 0, 0, err
+		}
+		size := int(binary.BigEndian.Uint16(temp))
+		if size < 2 {
+			return 0, 0, errBadJpeg
+		}
+		return marker, size - 2, nil
+	}
+}
+
+// findJpegXmp returns the XMP packet inside a JPEG.
+func findJpegXmp(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	temp := make([]byte, 2)
+	_, err = io.ReadFull(reader, temp)
+	if err != nil {
+		return nil, err
+	}
+	if temp[0] != 0xFF || temp[1] != 0xD8 {
+		return nil, errNoXmp
+	}
+	for {
+		marker, size, err := nextJpegSegment(reader)
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, errNoXmp
+		}
+		if marker == 0xE1 && size >= len(jpegXmpHeader) {
+			data := make([]byte, size)
+			_, err = io.ReadFull(reader, data)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(data, jpegXmpHeader) {
+				return data[len(jpegXmpHeader):], nil
+			}
+		} else {
+			_, err = reader.Discard(size)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// writeJpegXmp replaces the XMP segment of a JPEG, or adds one after the JFIF and Exif segments.
+// The new file is written next to the old one and then renamed over it.
+func writeJpegXmp(p string, packet []byte) error {
+	packet = append([]byte("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n"), bytes.TrimSpace(stripXpacket(packet))...)
+	packet = append(packet, "\n<?xpacket end=\"w\"?>"...)
+	if len(packet) > maxJpegXmp {
+		return errors.New("xmp is too big to fit in a jpeg")
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return errors.New("not a jpeg")
+	}
+	// Find the old segment, or where a new one goes
+	start, end := -1, -1
+	pos := 2
+	for {
+		if pos+2 > len(data) {
+			return errors.New("jpeg is truncated")
+		}
+		if data[pos] != 0xFF {
+			return errBadJpeg
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte
+			pos++
+			continue
+		} else if marker == 0xDA || marker == 0xD9 {
+			break
+		} else if !jpegHasLength(marker) {
+			pos += 2
+			continue
+		}
+		if pos+4 > len(data) {
+			return errors.New("jpeg is truncated")
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 {
+			return errBadJpeg
+		}
+		next := pos + 2 + size
+		if next > len(data) {
+			return errors.New("jpeg is truncated")
+		}
+		if marker == 0xE1 && bytes.HasPrefix(data[pos+4:next], jpegXmpHeader) {
+			start, end = pos, next
+			break
+		} else if marker == 0xE0 || marker == 0xE1 {
+			start, end = next, next
+		} else if start == -1 {
+			start, end = pos, pos
+		}
+		pos = next
+	}
+	if start == -1 {
+		start, end = pos, pos
+	}
+	segment := make([]byte, 4, 4+len(jpegXmpHeader)+len(packet))
+	segment[0], segment[1] = 0xFF, 0xE1
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(jpegXmpHeader)+len(packet)))
+	segment = append(segment, jpegXmpHeader...)
+	segment = append(segment, packet...)
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	temp := p + ".tmp"
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.Write(data[:start])
+	w.Write(segment)
+	w.Write(data[end:])
+	err = w.Flush()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(temp, p)
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+var xmpXpacket = regexp.MustCompile(`<\?xpacket[^>]*\?>`)
+
+// stripXpacket takes off the xpacket wrapper and padding that embedded XMP has, so it can be put in a sidecar.
+func stripXpacket(packet []byte) []byte {
+	return xmpXpacket.ReplaceAll(packet, nil)
+}
+
+// canEmbedXmp is false for JPEGs that can't be rewritten without breaking something.
+// Rewriting a file replaces it, so a symlink would become a copy and a hard link would stop being shared.
+func canEmbedXmp(p string) bool {
+	info, err := os.Lstat(p)
+	return err == nil && info.Mode().IsRegular() && linkCount(p) == 1
+}
+
+// writeXmp records the tags and rating of the image at p in its XMP, as set by the XMP option.
+// JPEGs have it embedded if the option says so, and everything else gets a sidecar.
+// If the image already has a sidecar, or is linked, a sidecar is used.
+func writeXmp(p string, meta xmpMeta) error {
+	side, hasSide := sidecarPath(p)
+	if config.Xmp == XMP_EMBED && isJpeg(p) && !hasSide && canEmbedXmp(p) {
+		packet, err := findJpegXmp(p)
+		if err != nil && err != errNoXmp {
+			return err
+		}
+		packet, err = setXmp(stripXpacket(packet), meta)
+		if err != nil {
+			return err
+		}
+		return rewriteKeepingIdentity(p, func() error { return writeJpegXmp(p, packet) })
+	}
+	var packet []byte
+	if hasSide {
+		var err error
+		packet, err = os.ReadFile(side)
+		if err != nil {
+			return err
+		}
+	} else if isJpeg(p) {
+		// Start from what is in the file, so the sidecar doesn't lose it
+		packet, _ = findJpegXmp(p)
+		packet = stripXpacket(packet)
+	}
+	packet, err := setXmp(packet, meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(side, packet, 0644)
+}
+
+// sidecarFor is the name of the sidecar of the image at p, either photo.jpg.xmp if full is set or photo.xmp.
+func sidecarFor(p string, full bool) string {
+	if full {
+		return p + ".xmp"
+	}
+	return strings.TrimSuffix(p, filepath.Ext(p)) + ".xmp"
+}
+
+// moveSidecar moves or copies the sidecar of the image that was at from to go with the image now at to.
+// A sidecar named like photo.xmp keeps that style. If there is already a file where the sidecar would go, it is left alone.
+func moveSidecar(from, to string, keep bool) error {
+	side, ok := sidecarPath(from)
+	if !ok {
+		return nil
+	}
+	newSide := sidecarFor(to, side == from+".xmp")
+	if _, err := os.Stat(newSide); err == nil {
+		return nil
+	}
+	if keep {
+		return copyFile(side, newSide)
+	}
+	_, err := moveAs(side, filepath.Dir(newSide), filepath.Base(newSide))
+	return err
+}
+
+// swapSidecars swaps the sidecars of two images that have swapped places.
+func swapSidecars(a, b string) error {
+	sideA, okA := sidecarPath(a)
+	sideB, okB := sidecarPath(b)
+	if (!okA && !okB) || sideA == sideB {
+		return nil
+	}
+	temp := sideA + ".tmp"
+	if okA {
+		err := os.Rename(sideA, temp)
+		if err != nil {
+			return err
+		}
+	}
+	if okB {
+		err := os.Rename(sideB, sidecarFor(a, sideB == b+".xmp"))
+		if err != nil {
+			return err
+		}
+	}
+	if okA {
+		return os.Rename(temp, sidecarFor(b, sideA == a+".xmp"))
+	}
+	return nil
+}
+
+// syncXmp writes the tags and rating of the image at p to its XMP, if the XMP option is on.
+// Pick flags have no place in XMP, so a pick is only written as its stars.
+func syncXmp(p string) error {
+	if config.Xmp == XMP_OFF {
+		return nil
+	}
+	r, _ := ratings.Get(p)
+	return writeXmp(filepath.FromSlash(p), xmpMeta{tags: tags.Get(p), hasTags: true, rating: r.xmpRating(), hasRating: true})
+}
+
+// loadXmp takes the tags and rating of the image at p from its XMP, if the XMP option is on and the XMP has them.
+// Images outside the library are skipped.
+func loadXmp(p string) {
+	if config.Xmp == XMP_OFF || !filepath.IsLocal(filepath.FromSlash(p)) {
+		return
+	}
+	meta, err := readXmp(filepath.FromSlash(p))
+	if err != nil {
+		return
+	}
+	if meta.hasTags {
+		tags.Set(p, meta.tags)
+	}
+	if meta.hasRating {
+		r, _ := ratings.Get(p)
+		if meta.rating < 0 {
+			r = Rating{Flag: FLAG_REJECT}
+		} else {
+			r.Stars = min(meta.rating, 5)
+			if r.Flag == FLAG_REJECT {
+				r.Flag = FLAG_NONE
+			}
+		}
+		ratings.Set(p, r)
+	}
+}
+
+// rewriteKeepingIdentity calls rewrite, which changes the metadata of the image at p but not what it looks like.
+// The file's hash and ignored duplicate pairs are moved over to its new fingerprint, so it doesn't have to be hashed again.
+func rewriteKeepingIdentity(p string, rewrite func() error) error {
+	key := filepath.ToSlash(p)
+	before := fingerprintKey(p)
+	entry, cached := hashes.Get(key)
+	if info, err := os.Stat(p); err != nil || !cached || entry.ModTime != info.ModTime().Unix() {
+		cached = false
+	}
+	err := rewrite()
+	if err != nil {
+		return err
+	}
+	after := fingerprintKey(p)
+	ignored.Rekey(before, after)
+	if cached {
+		if info, err := os.Stat(p); err == nil {
+			if size, fp, err := cache.Fingerprint(p); err == nil {
+				entry.ModTime, entry.Size, entry.Fingerprint = info.ModTime().Unix(), size, fp
+				hashes.Put(key, entry)
+			}
+		}
+	}
+	return nil
+}
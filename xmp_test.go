@@ -0,0 +1,219 @@
+/*
+Copyright (C) 2019-2022 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const xmpWithSubject = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:darktable="http://darktable.sf.net/"
+    darktable:history_end="3">
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>cat</rdf:li>
+     <rdf:li>  black   and white </rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+const xmpRatingAttr = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="4"/>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+const xmpRatingElem = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/">
+   <xmp:Rating>-1.0</xmp:Rating>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+const xmpNoDesc = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+func TestParseXmp(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		meta   xmpMeta
+	}{
+		{"empty", "", xmpMeta{}},
+		{"no metadata", emptyXmp, xmpMeta{}},
+		{"subject", xmpWithSubject, xmpMeta{tags: []string{"cat", "black and white"}, hasTags: true}},
+		{"rating attribute", xmpRatingAttr, xmpMeta{rating: 4, hasRating: true}},
+		{"rating element", xmpRatingElem, xmpMeta{rating: -1, hasRating: true}},
+	}
+	for _, tt := range tests {
+		meta, err := parseXmp([]byte(tt.packet))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+		} else if !reflect.DeepEqual(meta, tt.meta) {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, meta, tt.meta)
+		}
+	}
+}
+
+func TestSetXmp(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		set    xmpMeta
+		meta   xmpMeta
+		keep   []string
+	}{
+		{"new packet", "", xmpMeta{tags: []string{"dog"}, hasTags: true, rating: 2, hasRating: true},
+			xmpMeta{tags: []string{"dog"}, hasTags: true, rating: 2, hasRating: true}, nil},
+		{"replace subject", xmpWithSubject, xmpMeta{tags: []string{"dog", "a < b"}, hasTags: true},
+			xmpMeta{tags: []string{"dog", "a < b"}, hasTags: true}, []string{`darktable:history_end="3"`}},
+		{"clear subject", xmpWithSubject, xmpMeta{hasTags: true},
+			xmpMeta{}, []string{`darktable:history_end="3"`}},
+		{"keep subject", xmpWithSubject, xmpMeta{rating: 5, hasRating: true},
+			xmpMeta{tags: []string{"cat", "black and white"}, hasTags: true, rating: 5, hasRating: true}, nil},
+		{"replace rating attribute", xmpRatingAttr, xmpMeta{rating: 1, hasRating: true},
+			xmpMeta{rating: 1, hasRating: true}, nil},
+		{"replace rating element", xmpRatingElem, xmpMeta{rating: 3, hasRating: true},
+			xmpMeta{rating: 3, hasRating: true}, nil},
+		{"tags on self-closing description", xmpRatingAttr, xmpMeta{tags: []string{"dog"}, hasTags: true},
+			xmpMeta{tags: []string{"dog"}, hasTags: true, rating: 4, hasRating: true}, nil},
+	}
+	for _, tt := range tests {
+		out, err := setXmp([]byte(tt.packet), tt.set)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		meta, err := parseXmp(out)
+		if err != nil {
+			t.Errorf("%s: written packet doesn't parse: %s\n%s", tt.name, err.Error(), out)
+		} else if !reflect.DeepEqual(meta, tt.meta) {
+			t.Errorf("%s: got %+v, expected %+v\n%s", tt.name, meta, tt.meta, out)
+		}
+		for _, s := range tt.keep {
+			if !bytes.Contains(out, []byte(s)) {
+				t.Errorf("%s: lost %s\n%s", tt.name, s, out)
+			}
+		}
+		if n := strings.Count(string(out), "<dc:subject>"); n > 1 {
+			t.Errorf("%s: %d subjects\n%s", tt.name, n, out)
+		}
+		if n := strings.Count(string(out), "xmp:Rating"); n > 1 {
+			t.Errorf("%s: %d ratings\n%s", tt.name, n, out)
+		}
+	}
+}
+
+func TestSetXmpNoDescription(t *testing.T) {
+	_, err := setXmp([]byte(xmpNoDesc), xmpMeta{hasTags: true})
+	if err == nil {
+		t.Error("packet without rdf:Description was written")
+	}
+}
+
+// jpegSegment is a JPEG segment with marker m holding data.
+func jpegSegment(m byte, data string) []byte {
+	n := len(data) + 2
+	return append([]byte{0xFF, m, byte(n >> 8), byte(n)}, data...)
+}
+
+func TestJpegXmp(t *testing.T) {
+	var jfif, fill []byte
+	jfif = append(jfif, 0xFF, 0xD8)
+	jfif = append(jfif, jpegSegment(0xE0, "JFIF\x00")...)
+	// Fill bytes and a marker without a length before the next segment
+	fill = append(fill, jfif...)
+	fill = append(fill, 0xFF, 0xFF, 0xFF, 0xD0)
+	fill = append(fill, jpegSegment(0xDB, "table")...)
+	badLength := append(append([]byte{}, jfif...), 0xFF, 0xDB, 0x00, 0x01)
+	notMarker := append(append([]byte{}, jfif...), 0x00, 0xDB, 0x00, 0x04, 0x00, 0x00)
+	tests := []struct {
+		name string
+		head []byte
+		ok   bool
+	}{
+		{"plain", jfif, true},
+		{"fill bytes", fill, true},
+		{"short length", badLength, false},
+		{"missing marker", notMarker, false},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		p := filepath.Join(dir, tt.name+".jpg")
+		data := append(append([]byte{}, tt.head...), 0xFF, 0xDA)
+		data = append(data, "scan data"...)
+		err := os.WriteFile(p, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := setXmp(nil, xmpMeta{tags: []string{"dog"}, hasTags: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeJpegXmp(p, packet)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: corrupt jpeg was written", tt.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		// Writing it twice replaces the segment instead of adding another
+		err = writeJpegXmp(p, packet)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		out, _ := os.ReadFile(p)
+		if n := bytes.Count(out, jpegXmpHeader); n != 1 {
+			t.Errorf("%s: %d xmp segments", tt.name, n)
+		}
+		// The new segment goes after the JFIF one
+		if !bytes.HasPrefix(out, jfif) || !bytes.HasSuffix(out, data[len(jfif):]) {
+			t.Errorf("%s: image data was changed", tt.name)
+		}
+		found, err := findJpegXmp(p)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		meta, err := parseXmp(found)
+		if err != nil || !reflect.DeepEqual(meta.tags, []string{"dog"}) {
+			t.Errorf("%s: read back %+v, %v", tt.name, meta, err)
+		}
+	}
+}